@@ -0,0 +1,134 @@
+package accounts
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT      = "default"           /// the account used when the connection doesn't ask for one
+	VOLUMEWINDOW = 30 * 24 * time.Hour /// fee tiers go on the volume traded over this long
+)
+
+type traded struct {
+	at    time.Time
+	value float64
+}
+
+// / Account is the simulated state of a trading account, shared by all the connections using it
+type Account struct {
+	Name string
+
+	positions map[string]*Position /// margin positions by symbol
+	volume    []traded             /// simulated fills over the VOLUMEWINDOW, oldest first
+	openorder map[string]int       /// simulated open orders by symbol, over all the connections
+
+	margincfg    MarginCfg
+	collateral   float64
+	margincalled bool
+
+	balancescfg BalancesCfg
+	balances    map[string]float64 /// real (or seeded) balances by asset
+	changes     map[string]float64 /// simulated changes to the balances by asset
+	holds       map[string]hold    /// funds set aside for open orders by order id, over all the connections
+	lock        sync.Mutex
+}
+
+func NewAccount(name string, balancescfg BalancesCfg, margincfg MarginCfg) *Account {
+	margincfg.Expand()
+	account := &Account{
+		Name:        name,
+		positions:   make(map[string]*Position),
+		openorder:   make(map[string]int),
+		margincfg:   margincfg,
+		collateral:  margincfg.Collateral,
+		balancescfg: balancescfg,
+		balances:    make(map[string]float64),
+		changes:     make(map[string]float64),
+		holds:       make(map[string]hold),
+	}
+	if !balancescfg.Overlay {
+		for asset, balance := range balancescfg.Seed[name] {
+			account.balances[asset] = balance
+		}
+	}
+	return account
+}
+
+// / AddVolume adds a simulated fill's value (qty * price) to the rolling volume
+func (p *Account) AddVolume(value float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.volume = append(p.volume, traded{at: time.Now(), value: value})
+}
+
+// / Volume is the value traded over the VOLUMEWINDOW
+func (p *Account) Volume() float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	cutoff := time.Now().Add(-VOLUMEWINDOW)
+	expired := 0
+	for expired < len(p.volume) && p.volume[expired].at.Before(cutoff) {
+		expired++
+	}
+	p.volume = p.volume[expired:]
+	total := 0.0
+	for _, fill := range p.volume {
+		total += fill.value
+	}
+	return total
+}
+
+// / OrderOpened counts a simulated order going live, Kraken limits the open orders per account and pair
+func (p *Account) OrderOpened(symbol string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.openorder[symbol]++
+}
+
+// / OrderClosed counts a simulated order being filled, canceled or expired
+func (p *Account) OrderClosed(symbol string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.openorder[symbol] > 0 {
+		p.openorder[symbol]--
+	}
+}
+
+// / OpenOrders is the number of simulated orders open on the pair, from any connection
+func (p *Account) OpenOrders(symbol string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.openorder[symbol]
+}
+
+// / Accounts holds the accounts by name, creating them as they are asked for
+type Accounts struct {
+	accounts    map[string]*Account
+	balancescfg BalancesCfg
+	margincfg   MarginCfg
+	lock        sync.Mutex
+}
+
+func NewAccounts(balancescfg BalancesCfg, margincfg MarginCfg) *Accounts {
+	return &Accounts{
+		accounts:    make(map[string]*Account),
+		balancescfg: balancescfg,
+		margincfg:   margincfg,
+	}
+}
+
+// / GetAccount returns the named account, or the default account if name is empty
+func (p *Accounts) GetAccount(name string) *Account {
+	if name == "" {
+		name = DEFAULT
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	account, ok := p.accounts[name]
+	if !ok {
+		account = NewAccount(name, p.balancescfg, p.margincfg)
+		p.accounts[name] = account
+	}
+	return account
+}
@@ -0,0 +1,129 @@
+package accounts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccounts(t *testing.T) {
+	accounts := NewAccounts(BalancesCfg{}, MarginCfg{})
+	account := accounts.GetAccount("")
+	assert.Equal(t, DEFAULT, account.Name)
+	assert.Same(t, account, accounts.GetAccount(DEFAULT))
+	assert.NotSame(t, account, accounts.GetAccount("other"))
+
+	account.AddMarginTrade("BTC/USD", "buy", 1.5, 100, 0)
+	account.AddMarginTrade("BTC/USD", "sell", 0.5, 100, 0)
+	assert.Equal(t, 1.0, account.Position("BTC/USD"))
+	account.AddMarginTrade("BTC/USD", "sell", 2, 100, 0)
+	assert.Equal(t, -1.0, account.Position("BTC/USD"))
+	assert.Equal(t, 0.0, accounts.GetAccount("other").Position("BTC/USD"))
+
+	account.AddVolume(100)
+	account.AddVolume(50)
+	assert.Equal(t, 150.0, account.Volume())
+	///fills older than the window drop out
+	account.volume[0].at = time.Now().Add(-VOLUMEWINDOW - time.Minute)
+	assert.Equal(t, 50.0, account.Volume())
+}
+
+func TestBalances(t *testing.T) {
+	seed := map[string]map[string]float64{DEFAULT: {"USD": 100}}
+	account := NewAccounts(BalancesCfg{Enabled: true, Seed: seed}, MarginCfg{}).GetAccount("")
+	assert.True(t, account.SimulatesBalances())
+	assert.Equal(t, 100.0, account.Balance("USD"))
+	assert.Equal(t, 90.0, account.Change("USD", -10))
+	assert.Equal(t, 0.5, account.Change("BTC", 0.5))
+	assert.Equal(t, map[string]float64{"USD": 90, "BTC": 0.5}, account.Balances())
+
+	///what open orders hold is per order, replaced on each hold
+	account.Hold("ORDER1", "USD", 30)
+	account.Hold("ORDER2", "USD", 20)
+	account.Hold("ORDER2", "USD", 10)
+	account.Hold("ORDER3", "BTC", 0.1)
+	assert.Equal(t, 40.0, account.Held("USD"))
+	account.Release("ORDER1")
+	account.Release("ORDER4")
+	assert.Equal(t, 10.0, account.Held("USD"))
+	assert.Equal(t, 0.1, account.Held("BTC"))
+	///holding doesn't change the balance
+	assert.Equal(t, 90.0, account.Balance("USD"))
+
+	///overlaid, the seed is ignored and the changes apply to the real balance
+	account = NewAccounts(BalancesCfg{Enabled: true, Overlay: true, Seed: seed}, MarginCfg{}).GetAccount("")
+	assert.Equal(t, 0.0, account.Balance("USD"))
+	account.Change("USD", -10)
+	account.SetBalance("USD", 50)
+	assert.Equal(t, 40.0, account.Balance("USD"))
+}
+
+func TestMargin(t *testing.T) {
+	margincfg := MarginCfg{Enabled: true, Collateral: 1000, RolloverFee: 0.001}
+	margincfg.Expand()
+	assert.Equal(t, 5.0, margincfg.Leverage)
+	account := NewAccounts(BalancesCfg{}, margincfg).GetAccount("")
+	mark := func(price float64) func(string) float64 {
+		return func(string) float64 { return price }
+	}
+
+	///opening pays the opening fee, increasing averages the price
+	assert.Equal(t, 0.0, account.AddMarginTrade("BTC/USD", "buy", 1, 100, 0))
+	assert.Equal(t, 0.0, account.AddMarginTrade("BTC/USD", "buy", 1, 200, 0))
+	assert.Equal(t, 150.0, account.Positions()[0].AvgPrice)
+	assert.InDelta(t, 999.7, account.MarginStatus(mark(150)).Collateral, 1e-9)
+	///reversing realises the pnl on the long and opens a short
+	assert.Equal(t, 20.0, account.AddMarginTrade("BTC/USD", "sell", 3, 160, 0))
+	assert.Equal(t, -1.0, account.Position("BTC/USD"))
+	assert.Equal(t, 160.0, account.Positions()[0].AvgPrice)
+	status := account.MarginStatus(mark(170))
+	assert.InDelta(t, 1019.54, status.Collateral, 1e-9)
+	assert.InDelta(t, -10, status.UnrealisedPnl, 1e-9)
+	assert.InDelta(t, 32, status.Used, 1e-9)
+	assert.InDelta(t, 1009.54/32*100, status.Level, 1e-9)
+
+	///rollover is charged once per interval
+	assert.Equal(t, 0.0, account.ChargeRollover(time.Now()))
+	assert.InDelta(t, 0.16, account.ChargeRollover(time.Now().Add(4*time.Hour+time.Minute)), 1e-9)
+	assert.Equal(t, 0.0, account.ChargeRollover(time.Now().Add(4*time.Hour+time.Minute)))
+
+	///a margin call once the level falls below 80%, then liquidation at 40%
+	_, margincall, liquidate := account.CheckMargin(mark(1100))
+	assert.False(t, margincall)
+	assert.Nil(t, liquidate)
+	status, margincall, liquidate = account.CheckMargin(mark(1160))
+	assert.True(t, margincall)
+	assert.Nil(t, liquidate)
+	assert.InDelta(t, 19.38/32*100, status.Level, 1e-9)
+	_, margincall, liquidate = account.CheckMargin(mark(1170))
+	assert.False(t, margincall)
+	assert.Equal(t, 1, len(liquidate))
+	assert.Equal(t, -1.0, liquidate[0].Qty)
+	_, _, liquidate = account.CheckMargin(mark(1170))
+	assert.Nil(t, liquidate)
+
+	///closing out realises the loss
+	assert.InDelta(t, -1010, account.AddMarginTrade("BTC/USD", "buy", 1, 1170, 0), 1e-9)
+	assert.Equal(t, 0, len(account.Positions()))
+	_, margincall, _ = account.CheckMargin(mark(1170))
+	assert.False(t, margincall)
+
+	///the trade's fee comes off the collateral, as well as the opening fee
+	collateral := account.MarginStatus(mark(100)).Collateral
+	account.AddMarginTrade("BTC/USD", "buy", 1, 100, 0.26)
+	assert.InDelta(t, collateral-0.1-0.26, account.MarginStatus(mark(100)).Collateral, 1e-9)
+}
+
+func TestOpenOrders(t *testing.T) {
+	account := NewAccount(DEFAULT, BalancesCfg{}, MarginCfg{})
+	account.OrderOpened("BTC/USD")
+	account.OrderOpened("BTC/USD")
+	account.OrderOpened("ETH/USD")
+	assert.Equal(t, 2, account.OpenOrders("BTC/USD"))
+	account.OrderClosed("BTC/USD")
+	account.OrderClosed("ETH/USD")
+	account.OrderClosed("ETH/USD")
+	assert.Equal(t, 1, account.OpenOrders("BTC/USD"))
+	assert.Equal(t, 0, account.OpenOrders("ETH/USD"))
+}
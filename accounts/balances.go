@@ -0,0 +1,84 @@
+package accounts
+
+type BalancesCfg struct {
+	Enabled bool                          /// track simulated balances, reject orders without the funds, and serve the balances channel
+	Overlay bool                          /// apply the simulated changes to the real account's balances, rather than to Seed
+	Seed    map[string]map[string]float64 /// starting balances by account name, then asset
+}
+
+type hold struct {
+	asset string
+	qty   float64
+}
+
+// / Balance is the asset's balance, the real (or seeded) balance plus the simulated changes
+func (p *Account) Balance(asset string) float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.balances[asset] + p.changes[asset]
+}
+
+// / Balances returns all the balances by asset
+func (p *Account) Balances() map[string]float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	balances := make(map[string]float64)
+	for asset, balance := range p.balances {
+		balances[asset] = balance
+	}
+	for asset, change := range p.changes {
+		balances[asset] += change
+	}
+	return balances
+}
+
+// / SetBalance is for the real account's balance, when the simulated changes are overlaid on it
+func (p *Account) SetBalance(asset string, balance float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.balances[asset] = balance
+}
+
+// / Change applies a simulated change to the balance and returns the new balance
+func (p *Account) Change(asset string, amount float64) float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.changes[asset] += amount
+	return p.balances[asset] + p.changes[asset]
+}
+
+// / Hold sets aside qty of the asset for an open order, replacing whatever was held for it before
+func (p *Account) Hold(orderid string, asset string, qty float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.holds[orderid] = hold{asset: asset, qty: qty}
+}
+
+// / Release frees whatever was held for the order
+func (p *Account) Release(orderid string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.holds, orderid)
+}
+
+// / Held is how much of the asset the open orders on all the account's connections have set aside
+func (p *Account) Held(asset string) float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	held := 0.0
+	for _, h := range p.holds {
+		if h.asset == asset {
+			held += h.qty
+		}
+	}
+	return held
+}
+
+// / SimulatesBalances is true if the balances are tracked, see BalancesCfg
+func (p *Account) SimulatesBalances() bool {
+	return p.balancescfg.Enabled
+}
+
+func (p *Account) OverlaysBalances() bool {
+	return p.balancescfg.Overlay
+}
@@ -0,0 +1,214 @@
+package accounts
+
+import (
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"math"
+	"time"
+)
+
+type MarginCfg struct {
+	Enabled          bool    /// charge rollover, and make margin calls and liquidate on the margin level
+	Collateral       float64 /// what the positions are margined against, in the quote currency
+	Leverage         float64 /// Kraken margins orders at the pair's maximum leverage, defaults to 5
+	RolloverFee      float64 /// ratio of a position's cost charged on opening and every RolloverInterval
+	RolloverInterval string  /// e.g. "4h", the default
+	MarginCallLevel  float64 /// margin level % at which to make a margin call, defaults to 80
+	LiquidationLevel float64 /// margin level % at which to liquidate the positions, defaults to 40
+
+	rolloverinterval time.Duration
+}
+
+func (p *MarginCfg) Expand() {
+	if p.Leverage == 0 {
+		p.Leverage = 5
+	}
+	if p.RolloverInterval == "" {
+		p.RolloverInterval = "4h"
+	}
+	if p.MarginCallLevel == 0 {
+		p.MarginCallLevel = 80
+	}
+	if p.LiquidationLevel == 0 {
+		p.LiquidationLevel = 40
+	}
+	var err error
+	p.rolloverinterval, err = time.ParseDuration(p.RolloverInterval)
+	handlers.PanicOnError(err)
+}
+
+// / Position is a simulated margin position
+type Position struct {
+	Symbol   string
+	Qty      float64 /// +ve long, -ve short
+	AvgPrice float64 /// the average price the open qty was opened at
+
+	nextrollover time.Time
+	liquidating  bool
+}
+
+// / Cost is what the open qty cost
+func (p *Position) Cost() float64 {
+	return math.Abs(p.Qty) * p.AvgPrice
+}
+
+func (p *Position) UnrealisedPnl(markprice float64) float64 {
+	return p.Qty * (markprice - p.AvgPrice)
+}
+
+// / MarginStatus is the state of the account's margin, as Kraken's TradeBalance would report it
+type MarginStatus struct {
+	Collateral    float64 /// including realised PnL and less fees
+	UnrealisedPnl float64
+	Equity        float64 /// collateral plus unrealised PnL
+	Used          float64 /// the cost of the positions over the leverage
+	Level         float64 /// equity as a % of used margin, +Inf with no positions
+}
+
+// / Position is the net margin position in the symbol, +ve long, -ve short
+func (p *Account) Position(symbol string) float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	position, ok := p.positions[symbol]
+	if !ok {
+		return 0
+	}
+	return position.Qty
+}
+
+// / Positions returns a copy of the open positions
+func (p *Account) Positions() []Position {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	positions := make([]Position, 0, len(p.positions))
+	for _, position := range p.positions {
+		positions = append(positions, *position)
+	}
+	return positions
+}
+
+// / AddMarginTrade opens, increases, reduces, closes or reverses the position with a simulated margin fill, and
+// /   returns the PnL realised by it. Realised PnL, the trade's fee and the opening fee go to the collateral.
+func (p *Account) AddMarginTrade(symbol string, side string, qty float64, price float64, fee float64) (realised float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if side == "sell" {
+		qty = -qty
+	}
+	position, ok := p.positions[symbol]
+	if !ok {
+		position = &Position{Symbol: symbol}
+		p.positions[symbol] = position
+	}
+	opened := qty
+	if position.Qty != 0 && (position.Qty > 0) != (qty > 0) {
+		/// it reduces the position first
+		closed := math.Min(math.Abs(qty), math.Abs(position.Qty))
+		if position.Qty < 0 {
+			closed = -closed
+		}
+		realised = closed * (price - position.AvgPrice)
+		position.Qty -= closed
+		opened = qty + closed
+	}
+	if opened != 0 {
+		if position.Qty == 0 {
+			position.nextrollover = time.Now().Add(p.margincfg.rolloverinterval)
+		}
+		position.AvgPrice = (position.Cost() + math.Abs(opened)*price) / (math.Abs(position.Qty) + math.Abs(opened))
+		position.Qty += opened
+		if p.margincfg.Enabled {
+			p.collateral -= math.Abs(opened) * price * p.margincfg.RolloverFee
+		}
+	}
+	p.collateral += realised - fee
+	if position.Qty == 0 {
+		delete(p.positions, symbol)
+	}
+	return realised
+}
+
+// / ChargeRollover charges the rollover fee on every position due one, and returns the total charged.
+// /   It is safe for every connection on the account to call it.
+func (p *Account) ChargeRollover(now time.Time) float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.margincfg.Enabled || p.margincfg.rolloverinterval <= 0 {
+		return 0
+	}
+	charged := 0.0
+	for _, position := range p.positions {
+		for !now.Before(position.nextrollover) {
+			charged += position.Cost() * p.margincfg.RolloverFee
+			position.nextrollover = position.nextrollover.Add(p.margincfg.rolloverinterval)
+		}
+	}
+	p.collateral -= charged
+	return charged
+}
+
+// / MarginStatus values the positions at the mark prices, a position without a mark price is valued at cost
+func (p *Account) MarginStatus(markprice func(symbol string) float64) MarginStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.marginStatus(markprice)
+}
+
+func (p *Account) marginStatus(markprice func(symbol string) float64) MarginStatus {
+	status := MarginStatus{
+		Collateral: p.collateral,
+		Level:      math.Inf(1),
+	}
+	for _, position := range p.positions {
+		if mark := markprice(position.Symbol); mark > 0 {
+			status.UnrealisedPnl += position.UnrealisedPnl(mark)
+		}
+		status.Used += position.Cost() / p.margincfg.Leverage
+	}
+	status.Equity = status.Collateral + status.UnrealisedPnl
+	if status.Used > 0 {
+		status.Level = status.Equity / status.Used * 100
+	}
+	return status
+}
+
+// / FreeMargin is what is left for new positions
+func (p *Account) FreeMargin(markprice func(symbol string) float64) float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := p.marginStatus(markprice)
+	return status.Equity - status.Used
+}
+
+func (p *Account) Leverage() float64 {
+	return p.margincfg.Leverage
+}
+
+func (p *Account) SimulatesMargin() bool {
+	return p.margincfg.Enabled
+}
+
+// / CheckMargin returns whether a margin call is due (once, until the level recovers), and the positions to liquidate
+// /   if the level has fallen to the liquidation level. Positions are only handed out for liquidation once.
+func (p *Account) CheckMargin(markprice func(symbol string) float64) (status MarginStatus, margincall bool, liquidate []Position) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status = p.marginStatus(markprice)
+	if !p.margincfg.Enabled {
+		return status, false, nil
+	}
+	if status.Level > p.margincfg.MarginCallLevel {
+		p.margincalled = false
+		return status, false, nil
+	}
+	margincall = !p.margincalled
+	p.margincalled = true
+	if status.Level <= p.margincfg.LiquidationLevel {
+		for _, position := range p.positions {
+			if !position.liquidating {
+				position.liquidating = true
+				liquidate = append(liquidate, *position)
+			}
+		}
+	}
+	return status, margincall, liquidate
+}
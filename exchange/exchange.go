@@ -0,0 +1,223 @@
+package exchange
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	TIMEFORMAT = "2006-01-02T15:04:05.000000Z"
+
+	HEARTBEAT_INTERVAL = time.Second
+)
+
+var ErrClosed = errors.New("simulated exchange connection closed")
+
+// / methods only available on the private endpoint
+var privatemethods = map[string]bool{
+	"add_order":               true,
+	"amend_order":             true,
+	"edit_order":              true,
+	"cancel_order":            true,
+	"cancel_all":              true,
+	"cancel_all_orders_after": true,
+	"batch_add":               true,
+	"batch_cancel":            true,
+}
+
+var connectionid int64
+var connectionidlock sync.Mutex
+
+func nextConnectionId() int64 {
+	connectionidlock.Lock()
+	defer connectionidlock.Unlock()
+	connectionid++
+	return connectionid
+}
+
+// / Exchange stands in for a Kraken websocket connection when there is no upstream to connect to.
+// /   It answers requests the way Kraken answers validate only requests - add_order succeeds without
+// /   placing an order and cancel_order fails with an unknown order - which leaves the TradeIntercept
+// /   to generate the executions and cancel confirmations exactly as it does when proxying.
+type Exchange struct {
+	private bool
+
+	outgoing  chan []byte
+	closed    chan struct{}
+	closeonce sync.Once
+	heartbeat *time.Ticker
+}
+
+func NewExchange(private bool) *Exchange {
+	exchange := &Exchange{
+		private:   private,
+		outgoing:  make(chan []byte, 100),
+		closed:    make(chan struct{}),
+		heartbeat: time.NewTicker(HEARTBEAT_INTERVAL),
+	}
+	/// Kraken sends a status message as soon as the connection is up
+	exchange.queue(map[string]interface{}{
+		"channel": "status",
+		"type":    "update",
+		"data": []map[string]interface{}{
+			{
+				"api_version":   "v2",
+				"connection_id": nextConnectionId(),
+				"system":        "online",
+				"version":       "2.0.0",
+			},
+		},
+	})
+	return exchange
+}
+
+func (p *Exchange) Close() {
+	p.closeonce.Do(func() {
+		p.heartbeat.Stop()
+		close(p.closed)
+	})
+}
+
+func (p *Exchange) queue(resp interface{}) {
+	msg, err := json.Marshal(resp)
+	if err != nil {
+		/// we built the response ourselves, so this really shouldn't happen
+		panic(err)
+	}
+	select {
+	case p.outgoing <- msg:
+	case <-p.closed:
+	}
+}
+
+func (p *Exchange) response(method string, reqid interface{}, timein time.Time) map[string]interface{} {
+	resp := map[string]interface{}{
+		"method":   method,
+		"time_in":  timein.Format(TIMEFORMAT),
+		"time_out": time.Now().UTC().Format(TIMEFORMAT),
+	}
+	if reqid != nil {
+		resp["req_id"] = reqid
+	}
+	return resp
+}
+
+func (p *Exchange) success(method string, reqid interface{}, timein time.Time, result interface{}) map[string]interface{} {
+	resp := p.response(method, reqid, timein)
+	resp["success"] = true
+	if result != nil {
+		resp["result"] = result
+	}
+	return resp
+}
+
+func (p *Exchange) failure(method string, reqid interface{}, timein time.Time, errmsg string) map[string]interface{} {
+	resp := p.response(method, reqid, timein)
+	resp["success"] = false
+	resp["error"] = errmsg
+	return resp
+}
+
+// / SendMsg handles a northbound message as Kraken would, queuing any response for RecvMsg
+func (p *Exchange) SendMsg(data []byte) error {
+	select {
+	case <-p.closed:
+		return ErrClosed
+	default:
+	}
+	timein := time.Now().UTC()
+
+	datamap := make(map[string]interface{})
+	err := json.Unmarshal(data, &datamap)
+	if err != nil {
+		p.queue(p.failure("", nil, timein, "EGeneral:Invalid arguments"))
+		return nil
+	}
+	method, _ := datamap["method"].(string)
+	reqid := datamap["req_id"]
+	params, _ := datamap["params"].(map[string]interface{})
+
+	if privatemethods[method] && !p.private {
+		p.queue(p.failure(method, reqid, timein, "EGeneral:Permission denied"))
+		return nil
+	}
+
+	switch method {
+	case "ping":
+		p.queue(p.response("pong", reqid, timein))
+	case "subscribe", "unsubscribe":
+		p.queue(p.success(method, reqid, timein, p.subscribeResult(params)))
+	case "add_order":
+		result := map[string]interface{}{}
+		for _, key := range []string{"order_userref", "cl_ord_id"} {
+			if val, ok := params[key]; ok {
+				result[key] = val
+			}
+		}
+		p.queue(p.success(method, reqid, timein, result))
+	case "batch_add":
+		orders, _ := params["orders"].([]interface{})
+		results := make([]map[string]interface{}, 0, len(orders))
+		for _, order := range orders {
+			orderparams, _ := order.(map[string]interface{})
+			result := map[string]interface{}{}
+			for _, key := range []string{"order_userref", "cl_ord_id"} {
+				if val, ok := orderparams[key]; ok {
+					result[key] = val
+				}
+			}
+			results = append(results, result)
+		}
+		p.queue(p.success(method, reqid, timein, results))
+	case "cancel_all":
+		p.queue(p.success(method, reqid, timein, map[string]interface{}{"count": 0}))
+	case "cancel_all_orders_after":
+		///the trade intercept runs the timer for the simulated orders
+		timeout, _ := params["timeout"].(float64)
+		triggertime := "0"
+		if timeout > 0 {
+			triggertime = timein.Add(time.Duration(timeout) * time.Second).Format(time.RFC3339)
+		}
+		p.queue(p.success(method, reqid, timein, map[string]interface{}{
+			"currentTime": timein.Format(time.RFC3339),
+			"triggerTime": triggertime,
+		}))
+	case "cancel_order", "batch_cancel", "amend_order", "edit_order":
+		//// There are never any real orders to cancel or change
+		p.queue(p.failure(method, reqid, timein, "EOrder:Unknown order"))
+	default:
+		p.queue(p.failure(method, reqid, timein, fmt.Sprint("EGeneral:Invalid arguments:Unsupported method ", method)))
+	}
+	return nil
+}
+
+func (p *Exchange) subscribeResult(params map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, val := range params {
+		if key == "token" {
+			continue
+		}
+		result[key] = val
+	}
+	return result
+}
+
+// / RecvMsg blocks until there is a response to send south, or it is time for a heartbeat
+func (p *Exchange) RecvMsg() (data []byte, err error) {
+	select {
+	case msg := <-p.outgoing:
+		return msg, nil
+	default:
+	}
+	select {
+	case msg := <-p.outgoing:
+		return msg, nil
+	case <-p.heartbeat.C:
+		return []byte(`{"channel":"heartbeat"}`), nil
+	case <-p.closed:
+		return nil, ErrClosed
+	}
+}
@@ -0,0 +1,74 @@
+package exchange
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func recvMap(t *testing.T, exchange *Exchange) map[string]interface{} {
+	msg, err := exchange.RecvMsg()
+	assert.Nil(t, err)
+	datamap := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(msg, &datamap))
+	return datamap
+}
+
+func TestExchangeResponses(t *testing.T) {
+	exchange := NewExchange(true)
+	defer exchange.Close()
+
+	status := recvMap(t, exchange)
+	assert.Equal(t, "status", status["channel"])
+
+	err := exchange.SendMsg([]byte(`{"method":"ping","req_id":1}`))
+	assert.Nil(t, err)
+	pong := recvMap(t, exchange)
+	assert.Equal(t, "pong", pong["method"])
+	assert.Equal(t, 1.0, pong["req_id"])
+
+	err = exchange.SendMsg([]byte(`{"method":"add_order","req_id":2,"params":{"order_type":"limit","side":"buy",
+		"limit_price":100.5,"order_userref":7,"order_qty":1.5,"symbol":"BTC/USD","validate":true}}`))
+	assert.Nil(t, err)
+	addorder := recvMap(t, exchange)
+	assert.Equal(t, "add_order", addorder["method"])
+	assert.Equal(t, true, addorder["success"])
+	assert.Equal(t, 7.0, addorder["result"].(map[string]interface{})["order_userref"])
+
+	//// cancels always fail, just like a validate only order on Kraken
+	err = exchange.SendMsg([]byte(`{"method":"cancel_order","req_id":3,"params":{"order_userref":[7]}}`))
+	assert.Nil(t, err)
+	cancel := recvMap(t, exchange)
+	assert.Equal(t, false, cancel["success"])
+	assert.Equal(t, 3.0, cancel["req_id"])
+
+	err = exchange.SendMsg([]byte(`{"method":"subscribe","req_id":4,"params":{"channel":"executions","token":"abc"}}`))
+	assert.Nil(t, err)
+	subscribe := recvMap(t, exchange)
+	assert.Equal(t, true, subscribe["success"])
+	result := subscribe["result"].(map[string]interface{})
+	assert.Equal(t, "executions", result["channel"])
+	_, hastoken := result["token"]
+	assert.False(t, hastoken)
+
+	heartbeat, err := exchange.RecvMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"channel":"heartbeat"}`, string(heartbeat))
+
+	exchange.Close()
+	_, err = exchange.RecvMsg()
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, exchange.SendMsg([]byte(`{"method":"ping"}`)))
+}
+
+func TestPublicRejectsOrders(t *testing.T) {
+	exchange := NewExchange(false)
+	defer exchange.Close()
+	recvMap(t, exchange)
+
+	err := exchange.SendMsg([]byte(`{"method":"add_order","req_id":2,"params":{}}`))
+	assert.Nil(t, err)
+	addorder := recvMap(t, exchange)
+	assert.Equal(t, false, addorder["success"])
+}
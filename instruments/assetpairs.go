@@ -0,0 +1,107 @@
+package instruments
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// / AssetPair is the part of a pair from Kraken's REST AssetPairs response that describes it as a Pair.
+// /   Kraken sends the minimums and tick size as strings.
+type AssetPair struct {
+	Altname      string
+	Wsname       string
+	PairDecimals int    `json:"pair_decimals"`
+	CostDecimals int    `json:"cost_decimals"`
+	LotDecimals  int    `json:"lot_decimals"`
+	OrderMin     string `json:"ordermin"`
+	CostMin      string `json:"costmin"`
+	TickSize     string `json:"tick_size"`
+	LeverageBuy  []int  `json:"leverage_buy"`
+}
+
+type AssetPairsResp struct {
+	Error  []string
+	Result map[string]*AssetPair
+}
+
+// / wsAsset turns the v1 asset names into the v2 ones
+func wsAsset(asset string) string {
+	switch asset {
+	case "XBT":
+		return "BTC"
+	case "XDG":
+		return "DOGE"
+	}
+	return asset
+}
+
+func parseDecimal(field string, value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %s %s: %w", field, value, err)
+	}
+	return parsed, nil
+}
+
+func (p *AssetPair) pair() (*Pair, error) {
+	assets := strings.SplitN(p.Wsname, "/", 2)
+	if len(assets) < 2 {
+		return nil, fmt.Errorf("bad wsname %s", p.Wsname)
+	}
+	pair := &Pair{
+		Base:           wsAsset(assets[0]),
+		Quote:          wsAsset(assets[1]),
+		Status:         "online",
+		QtyPrecision:   p.LotDecimals,
+		PricePrecision: p.PairDecimals,
+		CostPrecision:  p.CostDecimals,
+		Marginable:     len(p.LeverageBuy) > 0,
+	}
+	pair.Symbol = pair.Base + "/" + pair.Quote
+	var err error
+	if pair.QtyMin, err = parseDecimal("ordermin", p.OrderMin); err != nil {
+		return nil, err
+	}
+	if pair.CostMin, err = parseDecimal("costmin", p.CostMin); err != nil {
+		return nil, err
+	}
+	if pair.PriceIncrement, err = parseDecimal("tick_size", p.TickSize); err != nil {
+		return nil, err
+	}
+	if len(p.LeverageBuy) > 0 {
+		pair.MarginInitial = 1 / float64(p.LeverageBuy[len(p.LeverageBuy)-1])
+	}
+	return pair, nil
+}
+
+// / LoadAssetPairs reads a saved copy of https://api.kraken.com/0/public/AssetPairs as v2 pairs
+func LoadAssetPairs(filename string) ([]*Pair, error) {
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	resp := AssetPairsResp{}
+	err = json.Unmarshal(contents, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse asset pairs %s: %w", filename, err)
+	}
+	pairs := make([]*Pair, 0, len(resp.Result))
+	for name, assetpair := range resp.Result {
+		if assetpair.Wsname == "" {
+			///not traded on the websockets
+			continue
+		}
+		pair, err := assetpair.pair()
+		if err != nil {
+			return nil, fmt.Errorf("asset pair %s: %w", name, err)
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
@@ -0,0 +1,214 @@
+package instruments
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+type InstrumentsCfg struct {
+	Snapshot   string /// a saved instrument channel snapshot message, the v2 way to describe the pairs
+	AssetPairs string /// and/or a saved REST AssetPairs response, pairs in the snapshot take precedence
+	Refresh    bool   /// update the pairs from the instrument channel when the trading engine subscribes to it
+	Strict     bool   /// reject orders on pairs that aren't known, otherwise they go unchecked
+}
+
+func (p *InstrumentsCfg) Expand() {
+	p.Snapshot = os.ExpandEnv(p.Snapshot)
+	p.AssetPairs = os.ExpandEnv(p.AssetPairs)
+}
+
+// / Asset is an asset from the instrument channel
+type Asset struct {
+	Id               string  `json:"id"`
+	Status           string  `json:"status"`
+	Precision        int     `json:"precision"`
+	PrecisionDisplay int     `json:"precision_display"`
+	Borrowable       bool    `json:"borrowable"`
+	CollateralValue  float64 `json:"collateral_value"`
+	MarginRate       float64 `json:"margin_rate"`
+}
+
+// / Pair is a pair from the instrument channel
+type Pair struct {
+	Symbol             string  `json:"symbol"`
+	Base               string  `json:"base"`
+	Quote              string  `json:"quote"`
+	Status             string  `json:"status"`
+	QtyPrecision       int     `json:"qty_precision"`
+	QtyIncrement       float64 `json:"qty_increment"`
+	QtyMin             float64 `json:"qty_min"`
+	PricePrecision     int     `json:"price_precision"`
+	PriceIncrement     float64 `json:"price_increment"`
+	CostPrecision      int     `json:"cost_precision"`
+	CostMin            float64 `json:"cost_min"`
+	Marginable         bool    `json:"marginable"`
+	MarginInitial      float64 `json:"margin_initial"`
+	PositionLimitLong  float64 `json:"position_limit_long"`
+	PositionLimitShort float64 `json:"position_limit_short"`
+	HasIndex           bool    `json:"has_index"`
+}
+
+// / priceIncrement falls back on the precision if the increment is missing
+func (p *Pair) priceIncrement() float64 {
+	if p.PriceIncrement > 0 {
+		return p.PriceIncrement
+	}
+	return math.Pow10(-p.PricePrecision)
+}
+
+func (p *Pair) qtyIncrement() float64 {
+	if p.QtyIncrement > 0 {
+		return p.QtyIncrement
+	}
+	return math.Pow10(-p.QtyPrecision)
+}
+
+// / multipleOf allows for the float not being exact
+func multipleOf(value float64, step float64) bool {
+	steps := value / step
+	return math.Abs(steps-math.Round(steps)) < 1e-6
+}
+
+// / ValidPrice is whether the price is a whole number of price increments
+func (p *Pair) ValidPrice(price float64) bool {
+	return multipleOf(price, p.priceIncrement())
+}
+
+// / ValidQty is whether the qty is a whole number of qty increments
+func (p *Pair) ValidQty(qty float64) bool {
+	return multipleOf(qty, p.qtyIncrement())
+}
+
+// / RoundPrice rounds to the nearest price increment
+func (p *Pair) RoundPrice(price float64) float64 {
+	increment := p.priceIncrement()
+	return math.Round(price/increment) * increment
+}
+
+// / RoundQty rounds down to a whole number of qty increments, so a fill never goes beyond what was asked for
+func (p *Pair) RoundQty(qty float64) float64 {
+	increment := p.qtyIncrement()
+	///a qty that is already whole mustn't lose an increment to the float not being exact
+	return math.Floor(qty/increment+1e-6) * increment
+}
+
+// / InstrumentData is the data of an instrument channel message
+type InstrumentData struct {
+	Assets []*Asset `json:"assets"`
+	Pairs  []*Pair  `json:"pairs"`
+}
+
+type InstrumentMsg struct {
+	Channel string         `json:"channel"`
+	Type    string         `json:"type"`
+	Data    InstrumentData `json:"data"`
+}
+
+// / Registry is what is known about the pairs and assets, shared by every connection.
+// /   Pairs and assets are replaced, never changed, so what the lookups return is safe to hold on to.
+type Registry struct {
+	pairs   map[string]*Pair
+	assets  map[string]*Asset
+	refresh bool
+	strict  bool
+	lock    sync.RWMutex
+}
+
+func NewRegistry(instrumentscfg InstrumentsCfg) (*Registry, error) {
+	registry := &Registry{
+		pairs:   make(map[string]*Pair),
+		assets:  make(map[string]*Asset),
+		refresh: instrumentscfg.Refresh,
+		strict:  instrumentscfg.Strict,
+	}
+	if instrumentscfg.AssetPairs != "" {
+		pairs, err := LoadAssetPairs(instrumentscfg.AssetPairs)
+		if err != nil {
+			return nil, err
+		}
+		registry.update(&InstrumentData{Pairs: pairs})
+	}
+	if instrumentscfg.Snapshot != "" {
+		contents, err := os.ReadFile(instrumentscfg.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		msg := &InstrumentMsg{}
+		err = json.Unmarshal(contents, msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse instrument snapshot %s: %w", instrumentscfg.Snapshot, err)
+		}
+		registry.update(&msg.Data)
+	}
+	return registry, nil
+}
+
+func (p *Registry) update(data *InstrumentData) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, pair := range data.Pairs {
+		p.pairs[pair.Symbol] = pair
+	}
+	for _, asset := range data.Assets {
+		p.assets[asset.Id] = asset
+	}
+}
+
+// / Refresh applies an instrument channel snapshot or update, if Refresh is set. Anything else is ignored.
+func (p *Registry) Refresh(msg []byte) error {
+	if !p.refresh {
+		return nil
+	}
+	instrumentmsg := &InstrumentMsg{}
+	err := json.Unmarshal(msg, instrumentmsg)
+	if err != nil {
+		return err
+	}
+	if instrumentmsg.Channel != "instrument" || instrumentmsg.Type == "" {
+		return nil
+	}
+	p.update(&instrumentmsg.Data)
+	return nil
+}
+
+// / Pair returns the pair, nil if it isn't known
+func (p *Registry) Pair(symbol string) *Pair {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.pairs[symbol]
+}
+
+// / Asset returns the asset, nil if it isn't known
+func (p *Registry) Asset(id string) *Asset {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.assets[id]
+}
+
+// / HasPairs is whether there is anything to check orders against
+func (p *Registry) HasPairs() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return len(p.pairs) > 0
+}
+
+// / Strict is whether orders on pairs that aren't known are rejected
+func (p *Registry) Strict() bool {
+	return p.strict
+}
+
+// / Assets returns the base and quote assets of the symbol, from the symbol itself if the pair isn't known
+func (p *Registry) Assets(symbol string) (base string, quote string) {
+	if pair := p.Pair(symbol); pair != nil {
+		return pair.Base, pair.Quote
+	}
+	assets := strings.SplitN(symbol, "/", 2)
+	if len(assets) < 2 {
+		return symbol, ""
+	}
+	return assets[0], assets[1]
+}
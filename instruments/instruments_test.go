@@ -0,0 +1,69 @@
+package instruments
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, "instruments.json")
+	assert.Nil(t, os.WriteFile(snapshot, []byte(`{"channel":"instrument","type":"snapshot","data":{
+		"assets":[{"id":"BTC","status":"enabled","precision":10,"borrowable":true,"collateral_value":1,"margin_rate":0.01}],
+		"pairs":[{"symbol":"BTC/USD","base":"BTC","quote":"USD","status":"online","qty_precision":8,
+			"qty_increment":0.00000001,"qty_min":0.0001,"price_precision":1,"price_increment":0.1,"cost_precision":5,
+			"cost_min":0.5,"marginable":true,"margin_initial":0.2}]}}`), 0644))
+	assetpairs := filepath.Join(dir, "asset-pairs.json")
+	assert.Nil(t, os.WriteFile(assetpairs, []byte(`{"error":[],"result":{
+		"XXBTZUSD":{"altname":"XBTUSD","wsname":"XBT/USD","pair_decimals":2,"lot_decimals":8,"ordermin":"0.001"},
+		"XDGUSD":{"altname":"XDGUSD","wsname":"XDG/USD","pair_decimals":7,"lot_decimals":0,"ordermin":"13",
+			"costmin":"0.5","leverage_buy":[2,3]},
+		"XBTUSD.d":{"altname":"XBTUSD.d"}}}`), 0644))
+
+	registry, err := NewRegistry(InstrumentsCfg{Snapshot: snapshot, AssetPairs: assetpairs})
+	assert.Nil(t, err)
+	///the snapshot wins
+	pair := registry.Pair("BTC/USD")
+	assert.Equal(t, 0.0001, pair.QtyMin)
+	assert.True(t, pair.ValidPrice(100.1))
+	assert.False(t, pair.ValidPrice(100.15))
+	assert.InDelta(t, 100.2, pair.RoundPrice(100.15), 1e-9)
+	assert.True(t, pair.ValidQty(0.12345678))
+	assert.False(t, pair.ValidQty(0.123456789))
+	assert.InDelta(t, 0.12345678, pair.RoundQty(0.123456789), 1e-12)
+	assert.Equal(t, 0.3, pair.RoundQty(0.3))
+	assert.Equal(t, 0.01, registry.Asset("BTC").MarginRate)
+
+	///the v1 names are turned into the v2 ones, and the increments come from the decimals
+	pair = registry.Pair("DOGE/USD")
+	assert.Equal(t, "DOGE", pair.Base)
+	assert.True(t, pair.ValidPrice(0.1234567))
+	assert.False(t, pair.ValidQty(13.5))
+	assert.Equal(t, 13.0, pair.QtyMin)
+	assert.True(t, pair.Marginable)
+	assert.InDelta(t, 1.0/3, pair.MarginInitial, 1e-9)
+
+	base, quote := registry.Assets("DOGE/USD")
+	assert.Equal(t, "DOGE", base)
+	assert.Equal(t, "USD", quote)
+	base, quote = registry.Assets("SOL/EUR")
+	assert.Equal(t, "SOL", base)
+	assert.Equal(t, "EUR", quote)
+
+	///the instrument channel is ignored unless refreshing
+	update := []byte(`{"channel":"instrument","type":"update","data":{"pairs":[{"symbol":"SOL/EUR","base":"SOL","quote":"EUR"}]}}`)
+	assert.Nil(t, registry.Refresh(update))
+	assert.Nil(t, registry.Pair("SOL/EUR"))
+	registry, err = NewRegistry(InstrumentsCfg{Refresh: true})
+	assert.Nil(t, err)
+	assert.False(t, registry.HasPairs())
+	assert.Nil(t, registry.Refresh([]byte(`{"method":"subscribe","result":{"channel":"instrument"},"success":true}`)))
+	assert.Nil(t, registry.Refresh(update))
+	assert.Equal(t, "SOL", registry.Pair("SOL/EUR").Base)
+
+	_, err = NewRegistry(InstrumentsCfg{Snapshot: filepath.Join(dir, "missing.json")})
+	assert.NotNil(t, err)
+}
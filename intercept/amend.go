@@ -0,0 +1,134 @@
+package intercept
+
+import (
+	"encoding/json"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"time"
+)
+
+const (
+	AMEND_QTY_ERROR = "EGeneral:Invalid arguments:order_qty" /// less than has already filled
+)
+
+func (p *TradeIntercept) northboundAmend(msg []byte) {
+	amendreq := &AmendReq{}
+	err := json.Unmarshal(msg, amendreq)
+	handlers.PanicOnError(err)
+	p.amendrequests <- amendreq
+}
+
+// / Hold the amend requests until the response comes back
+func (p *TradeIntercept) handleAmendReq() {
+	for len(p.amendrequests) > 0 {
+		p.pendingamends = append(p.pendingamends, <-p.amendrequests)
+	}
+}
+
+// / takeAmend removes and returns the oldest amend or edit waiting for a response with the req_id, 0 for none
+func (p *TradeIntercept) takeAmend(method string, reqid int64) *AmendReq {
+	for i, amendreq := range p.pendingamends {
+		if amendreq.Method == method && amendreq.ReqId == reqid {
+			p.pendingamends = append(p.pendingamends[:i], p.pendingamends[i+1:]...)
+			return amendreq
+		}
+	}
+	return nil
+}
+
+// / checkAmend returns the error Kraken would refuse the amend with - cutting the qty to what has already filled,
+// /   or a price or qty that breaks the pair's rules
+func (p *TradeIntercept) checkAmend(order *Order, amendreq *AmendReq) string {
+	amended := *order
+	if amendreq.Params.OrderQty > 0 {
+		if amendreq.Params.OrderQty <= order.CumQty {
+			return AMEND_QTY_ERROR
+		}
+		amended.OrderQty = amendreq.Params.OrderQty
+	}
+	if amendreq.Params.LimitPrice > 0 {
+		amended.LimitPrice = amendreq.Params.LimitPrice
+	}
+	return p.checkPair(&amended)
+}
+
+// / The validate only upstream can't find the order to amend, so if we have it, apply the amend to the
+// /   pending trade and replace the response with a success, or with Kraken's error if the amend breaks the rules
+func (p *TradeIntercept) processAmend(datamap map[string]interface{}, msg []byte) bool {
+	method, _ := datamap["method"].(string)
+	fltreqid, _ := datamap["req_id"].(float64)
+	reqid := int64(fltreqid)
+	amendreq := p.takeAmend(method, reqid)
+	if amendreq == nil {
+		return true
+	}
+
+	order := p.pendingtrades.find(amendreq.Params.OrderId, amendreq.Params.ClOrdId)
+	if order == nil || !order.IsOpen() {
+		///not one of ours (or already filled) - let the upstream's answer through
+		return true
+	}
+	timein := time.Now().Format(TIMEFORMAT)
+	if reason := p.checkAmend(order, amendreq); reason != "" {
+		p.log("Replacing ", string(msg), " with ", reason)
+		p.responses <- &ErrorResp{
+			Error:   reason,
+			Method:  amendreq.Method,
+			ReqId:   reqid,
+			Success: false,
+			TimeIn:  timein,
+			TimeOut: time.Now().Format(TIMEFORMAT),
+		}
+		return false
+	}
+	/// only reducing the qty keeps our place in the queue, and an edit is a new order anyway
+	requeue := amendreq.Method == "edit_order"
+	if amendreq.Params.OrderQty > 0 {
+		requeue = requeue || amendreq.Params.OrderQty > order.OrderQty
+		order.OrderQty = amendreq.Params.OrderQty
+	}
+	if amendreq.Params.LimitPrice > 0 {
+		requeue = requeue || amendreq.Params.LimitPrice != order.LimitPrice
+		order.LimitPrice = amendreq.Params.LimitPrice
+	}
+	if requeue {
+		p.leaveQueue(order)
+		p.joinQueue(order)
+	}
+
+	resp := &AmendResp{
+		Method:  amendreq.Method,
+		ReqId:   reqid,
+		Success: true,
+		TimeIn:  timein,
+	}
+	var report *Execution
+	if amendreq.Method == "edit_order" {
+		/// an edit replaces the order with a new one
+		resp.Result.OriginalOrderId = order.OrderId
+		p.account.Release(order.OrderId)
+		p.pendingtrades.reindex(order, func() {
+			if amendreq.Params.OrderUserref != 0 {
+				order.OrderUserref = amendreq.Params.OrderUserref
+			}
+			order.OrderId = p.ids.OrderId()
+		})
+		report = p.orderReport(order, "restated")
+	} else {
+		resp.Result.AmendId = p.ids.AmendId()
+		report = p.orderReport(order, "amended")
+		report.Amended = true
+	}
+	report.Reason = "User requested"
+	p.holdFunds(order)
+	resp.Result.OrderId = order.OrderId
+	resp.Result.ClOrdId = order.ClOrdId
+	resp.TimeOut = time.Now().Format(TIMEFORMAT)
+
+	success, _ := datamap["success"].(bool)
+	if !success {
+		p.log("Replacing ", string(msg), " with successful ", amendreq.Method)
+		p.responses <- resp
+	}
+	p.traderesp <- []*Execution{report}
+	return success
+}
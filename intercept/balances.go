@@ -0,0 +1,184 @@
+package intercept
+
+import (
+	"encoding/json"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"sort"
+	"time"
+)
+
+const (
+	FUNDS_ERROR = "EOrder:Insufficient funds"
+)
+
+// / Subscribing to the balances channel - the southbound thread takes it from here
+func (p *TradeIntercept) northboundBalances(subscribe bool) {
+	if p.account.SimulatesBalances() {
+		p.balancesubs <- subscribe
+	}
+}
+
+// / handleBalanceSubs sends new subscribers a snapshot, unless it is the real account's snapshot that is wanted
+func (p *TradeIntercept) handleBalanceSubs() {
+	for len(p.balancesubs) > 0 {
+		p.balancesubscribed = <-p.balancesubs
+		if p.balancesubscribed && !p.account.OverlaysBalances() {
+			p.responses <- p.balancesSnapshot()
+		}
+	}
+}
+
+func (p *TradeIntercept) balancesSnapshot() *BalancesMsg {
+	balances := p.account.Balances()
+	assets := make([]string, 0, len(balances))
+	for asset := range balances {
+		assets = append(assets, asset)
+	}
+	sort.Strings(assets)
+	data := make([]Balance, 0, len(assets))
+	for _, asset := range assets {
+		data = append(data, Balance{Asset: asset, AssetClass: "currency", Balance: balances[asset]})
+	}
+	p.balancesequence++
+	return &BalancesMsg{
+		Channel:  "balances",
+		Type:     "snapshot",
+		Data:     data,
+		Sequence: p.balancesequence,
+	}
+}
+
+// / processBalances handles the real account's balances. They are dropped if the simulated balances replace them,
+// /   otherwise they become the balances the simulated changes are made to.
+func (p *TradeIntercept) processBalances(datamap map[string]interface{}, msg []byte) (out []byte, forward bool) {
+	if !p.account.SimulatesBalances() {
+		return msg, true
+	}
+	if !p.account.OverlaysBalances() {
+		return msg, false
+	}
+	entries, _ := datamap["data"].([]interface{})
+	for _, entry := range entries {
+		entrymap, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		asset, _ := entrymap["asset"].(string)
+		balance, ok := entrymap["balance"].(float64)
+		if !ok {
+			continue
+		}
+		p.account.SetBalance(asset, balance)
+		entrymap["balance"] = p.account.Balance(asset)
+	}
+	out, err := json.Marshal(datamap)
+	handlers.PanicOnError(err)
+	return out, true
+}
+
+// / moveFunds updates the balances for a fill, and tells the subscriber. Margin fills don't move the spot balances.
+func (p *TradeIntercept) moveFunds(trade *Execution, order *Order) {
+	if !p.account.SimulatesBalances() || order.Margin {
+		return
+	}
+	baseasset, quoteasset := p.instruments.Assets(order.Symbol)
+	base := trade.LastQty
+	quote := trade.LastQty * trade.LastPrice
+	if order.Side == "sell" {
+		base, quote = -base, -quote
+	} else {
+		quote = -quote
+	}
+	basefee, quotefee := 0.0, 0.0
+	for _, fee := range trade.Fees {
+		if fee.Asset == baseasset {
+			basefee += fee.Qty
+		} else {
+			quotefee += fee.Qty
+		}
+	}
+	entries := []LedgerEntry{
+		p.ledgerEntry(trade, baseasset, base, basefee),
+		p.ledgerEntry(trade, quoteasset, quote, quotefee),
+	}
+	if p.balancesubscribed {
+		p.balancesequence++
+		p.responses <- &BalancesMsg{
+			Channel:  "balances",
+			Type:     "update",
+			Data:     entries,
+			Sequence: p.balancesequence,
+		}
+	}
+}
+
+func (p *TradeIntercept) ledgerEntry(trade *Execution, asset string, amount float64, fee float64) LedgerEntry {
+	balance := p.account.Change(asset, amount-fee)
+	return LedgerEntry{
+		Asset:      asset,
+		AssetClass: "currency",
+		Amount:     amount,
+		Balance:    balance,
+		Fee:        fee,
+		LedgerId:   p.ids.LedgerId(),
+		RefId:      trade.ExecId,
+		Timestamp:  time.Now().Format(TIMEFORMAT),
+		Type:       "trade",
+		Category:   "trade",
+		WalletType: "spot",
+		WalletId:   "main",
+	}
+}
+
+// / checkFunds returns Kraken's insufficient funds error if the balance, less what the account's open orders
+// /   hold (on any connection), won't cover the order
+func (p *TradeIntercept) checkFunds(order *Order) string {
+	if !p.account.SimulatesBalances() || order.Margin {
+		return ""
+	}
+	asset, needed := p.fundsNeeded(order)
+	if needed < 0 {
+		///no price to go on
+		return ""
+	}
+	///a little slack for rounding
+	if needed+p.account.Held(asset) > p.account.Balance(asset)+1e-9 {
+		return FUNDS_ERROR
+	}
+	return ""
+}
+
+// / holdFunds sets aside on the account what the rest of the order needs, so other orders can't spend it
+func (p *TradeIntercept) holdFunds(order *Order) {
+	if !p.account.SimulatesBalances() || order.Margin {
+		return
+	}
+	asset, needed := p.fundsNeeded(order)
+	if needed <= 0 {
+		p.account.Release(order.OrderId)
+		return
+	}
+	p.account.Hold(order.OrderId, asset, needed)
+}
+
+// / fundsNeeded is what the rest of the order needs - a buy needs the quote asset (and the taker fee),
+// /   a sell the base asset. -1 if there's no price for a buy.
+func (p *TradeIntercept) fundsNeeded(order *Order) (asset string, needed float64) {
+	base, quote := p.instruments.Assets(order.Symbol)
+	if order.Side == "sell" {
+		return base, order.LeavesQty()
+	}
+	price := order.LimitPrice
+	if order.IsMarket() {
+		///what the market is at
+		orderbook := p.orderbooks.GetOrderbook(order.Symbol)
+		price = orderbook.LastPrice()
+		if price <= 0 {
+			price = orderbook.MidPrice()
+		}
+	}
+	if price <= 0 {
+		return quote, -1
+	}
+	return quote, order.LeavesQty() * price * (1 + p.takerfee)
+}
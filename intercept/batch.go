@@ -0,0 +1,182 @@
+package intercept
+
+import (
+	"encoding/json"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"strconv"
+	"time"
+)
+
+// / A batch_add waiting for its response
+type pendingBatch struct {
+	reqid  int64
+	orders []*Order
+}
+
+func (p *TradeIntercept) northboundBatchAdd(msg []byte) {
+	batchreq := &BatchAddReq{}
+	err := json.Unmarshal(msg, batchreq)
+	handlers.PanicOnError(err)
+	for i := range batchreq.Params.Orders {
+		batchreq.Params.Orders[i].Symbol = batchreq.Params.Symbol
+		batchreq.Params.Orders[i].Validate = batchreq.Params.Validate
+	}
+	p.batchrequests <- batchreq
+}
+
+func (p *TradeIntercept) northboundBatchCancel(msg []byte) {
+	batchcancel := &BatchCancelReq{}
+	err := json.Unmarshal(msg, batchcancel)
+	handlers.PanicOnError(err)
+	p.batchcancels <- batchcancel
+}
+
+// / Create a pending trade for each order in the batch, remembering which batch they belong to
+// /   so the batch response can be matched up by req_id, or in order for batches without one
+func (p *TradeIntercept) handleBatchReq() {
+	for len(p.batchrequests) > 0 {
+		batchreq := <-p.batchrequests
+		orders := make([]*Order, 0, len(batchreq.Params.Orders))
+		for i := range batchreq.Params.Orders {
+			orderreq := &OrderReq{
+				Method: "add_order",
+				Params: batchreq.Params.Orders[i],
+				ReqId:  batchreq.ReqId,
+			}
+			order := p.addPendingOrder(orderreq, p.ids.OrderId())
+			order.batch = true
+			orders = append(orders, order)
+		}
+		p.pendingbatches = append(p.pendingbatches, &pendingBatch{reqid: batchreq.ReqId, orders: orders})
+	}
+}
+
+// / Hold the batch cancels until the response comes back
+func (p *TradeIntercept) handleBatchCancelReq() {
+	for len(p.batchcancels) > 0 {
+		p.pendingbatchcancels = append(p.pendingbatchcancels, <-p.batchcancels)
+	}
+}
+
+// / takeBatch removes and returns the oldest batch_add waiting for a response with the req_id, 0 for none
+func (p *TradeIntercept) takeBatch(reqid int64) *pendingBatch {
+	for i, batch := range p.pendingbatches {
+		if batch.reqid == reqid {
+			p.pendingbatches = append(p.pendingbatches[:i], p.pendingbatches[i+1:]...)
+			return batch
+		}
+	}
+	return nil
+}
+
+// / takeBatchCancel removes and returns the oldest batch_cancel waiting for a response with the req_id, 0 for none
+func (p *TradeIntercept) takeBatchCancel(reqid int64) *BatchCancelReq {
+	for i, batchcancel := range p.pendingbatchcancels {
+		if batchcancel.ReqId == reqid {
+			p.pendingbatchcancels = append(p.pendingbatchcancels[:i], p.pendingbatchcancels[i+1:]...)
+			return batchcancel
+		}
+	}
+	return nil
+}
+
+func (p *TradeIntercept) processBatchAdd(datamap map[string]interface{}, msg []byte) []byte {
+	///req_id is optional, batches without one are answered in order
+	fltreqid, _ := datamap["req_id"].(float64)
+	reqid := int64(fltreqid)
+	batch := p.takeBatch(reqid)
+	if batch == nil {
+		return msg
+	}
+	orders := batch.orders
+
+	success, _ := datamap["success"].(bool)
+	if success {
+		///one bad order rejects the whole batch
+		for _, order := range orders {
+			if order.Status != PENDING_NEW {
+				continue
+			}
+			if reason := p.checkOrder(order); reason != "" {
+				p.log("Replacing ", string(msg), " with ", reason)
+				for _, order := range orders {
+					p.account.Release(order.OrderId)
+					p.pendingtrades.remove(order)
+				}
+				return p.rejection("batch_add", reqid, reason)
+			}
+			///the later orders in the batch can't spend what this one needs
+			p.holdFunds(order)
+		}
+	}
+	accepted := make([]*Order, 0, len(orders))
+	for _, order := range orders {
+		if order.Status != PENDING_NEW {
+			continue
+		}
+		if !success {
+			///the batch was rejected, so none of the orders exist
+			p.pendingtrades.remove(order)
+			continue
+		}
+		p.acceptOrder(order)
+		/// Same as for a single order - in full test mode the whole batch fills straight away
+		p.startMatching(order)
+		accepted = append(accepted, order)
+	}
+	if len(accepted) == 0 {
+		return msg
+	}
+	return p.withOrderIds(datamap, accepted)
+}
+
+// / Batch cancels hold either order ids or userrefs in the orders, plus any cl_ord_ids
+func batchCancelParams(batchcancel *BatchCancelReq) CancelParams {
+	params := CancelParams{
+		ClOrdId: batchcancel.Params.ClOrdId,
+	}
+	for _, order := range batchcancel.Params.Orders {
+		switch id := order.(type) {
+		case float64:
+			params.Orderuserref = append(params.Orderuserref, int64(id))
+		case string:
+			userref, err := strconv.ParseInt(id, 10, 64)
+			if err == nil {
+				params.Orderuserref = append(params.Orderuserref, userref)
+				continue
+			}
+			params.OrderId = append(params.OrderId, id)
+		}
+	}
+	return params
+}
+
+func (p *TradeIntercept) processBatchCancel(datamap map[string]interface{}, msg []byte) bool {
+	fltreqid, _ := datamap["req_id"].(float64)
+	reqid := int64(fltreqid)
+	batchcancel := p.takeBatchCancel(reqid)
+	if batchcancel == nil {
+		return true
+	}
+	canceled := p.cancelPendingTrades(&CancelRequest{
+		Method: "cancel_order",
+		Params: batchCancelParams(batchcancel),
+		ReqId:  batchcancel.ReqId,
+	})
+
+	success, _ := datamap["success"].(bool)
+	if success {
+		return true
+	}
+	//replace this message with a success message for the whole batch
+	p.log("Replacing ", string(msg), " with successful batch cancel")
+	p.responses <- &BatchCancelResp{
+		Method:          "batch_cancel",
+		OrdersCancelled: len(canceled),
+		ReqId:           reqid,
+		Success:         true,
+		TimeIn:          time.Now().Format(TIMEFORMAT),
+		TimeOut:         time.Now().Format(TIMEFORMAT),
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package intercept
+
+import (
+	"encoding/json"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"log"
+	"time"
+)
+
+// / cancelAll cancels every pending order, moving them to the past trades
+func (p *TradeIntercept) cancelAll(reason string) int {
+	reports := make([]*Execution, 0, p.pendingtrades.len())
+	for _, order := range p.pendingtrades.all() {
+		reports = append(reports, p.closeOrder(order, CANCELED, reason))
+	}
+	if len(reports) > 0 {
+		p.traderesp <- reports
+	}
+	return len(reports)
+}
+
+// / Kraken only knows about its own (real) orders, so the count in its response is replaced with
+// /   the number of simulated orders canceled as well
+func (p *TradeIntercept) processCancelAll(datamap map[string]interface{}, msg []byte) []byte {
+	count := p.cancelAll("User requested")
+	success, _ := datamap["success"].(bool)
+	if success {
+		result, _ := datamap["result"].(map[string]interface{})
+		upstreamcount, _ := result["count"].(float64)
+		count += int(upstreamcount)
+	}
+	reqid, _ := datamap["req_id"].(float64)
+	timein, _ := datamap["time_in"].(string)
+	resp := CancelAllResp{
+		Method: "cancel_all",
+		ReqId:  int64(reqid),
+		Result: CancelAllResult{
+			Count: count,
+		},
+		Success: true,
+		TimeIn:  timein,
+		TimeOut: time.Now().Format(TIMEFORMAT),
+	}
+	if resp.TimeIn == "" {
+		resp.TimeIn = resp.TimeOut
+	}
+	rewritten, err := json.Marshal(resp)
+	handlers.PanicOnError(err)
+	p.log("Replacing ", string(msg), " with ", string(rewritten))
+	return rewritten
+}
+
+// / The dead man's switch - (re)arm or disarm the timer. Only the northbound thread touches the timer,
+// /   when it fires the southbound thread is told to cancel everything.
+func (p *TradeIntercept) northboundCancelAfter(msg []byte) {
+	cancelafter := CancelAfterReq{}
+	err := json.Unmarshal(msg, &cancelafter)
+	handlers.PanicOnError(err)
+
+	if p.deadmanswitch != nil {
+		p.deadmanswitch.Stop()
+		p.deadmanswitch = nil
+	}
+	if cancelafter.Params.Timeout <= 0 {
+		p.log("cancel_all_orders_after disabled")
+		return
+	}
+	timeout := time.Duration(cancelafter.Params.Timeout) * time.Second
+	p.deadmanswitch = p.afterfunc(timeout, func() {
+		log.Println("cancel_all_orders_after timed out after", timeout, "- canceling all orders")
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		select {
+		case p.deadmanfired <- struct{}{}:
+		default:
+			///already waiting to cancel
+		}
+	})
+}
+
+func (p *TradeIntercept) checkDeadManSwitch() {
+	select {
+	case <-p.deadmanfired:
+		p.cancelAll("Cancel all orders after timeout")
+	default:
+	}
+}
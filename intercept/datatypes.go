@@ -2,16 +2,31 @@ package intercept
 
 import "time"
 
+// / The trigger for stop-loss, take-profit and trailing-stop orders
+type TriggerParams struct {
+	Reference string  `json:"reference"`  /// last (the default) or index
+	Price     float64 `json:"price"`      /// for trailing stops, the offset from the peak
+	PriceType string  `json:"price_type"` /// static (the default), pct or quote - the last two relative to the reference
+}
+
 type OrderParams struct {
-	LimitPrice   float64 `json:"limit_price"`
-	OrderType    string  `json:"order_type"`
-	OrderUserref int64   `json:"order_userref"`
-	OrderQty     float64 `json:"order_qty"`
-	Side         string  `json:"side"`
-	Symbol       string  `json:"symbol"`
-	Token        string  `json:"token"`
-	Validate     bool    `json:"validate"`
-	Margin       bool    `json:"margin"`
+	LimitPrice     float64        `json:"limit_price"`
+	LimitPriceType string         `json:"limit_price_type"` /// static, pct or quote - relative to the trigger price
+	OrderType      string         `json:"order_type"`
+	OrderUserref   int64          `json:"order_userref"`
+	ClOrdId        string         `json:"cl_ord_id"`
+	OrderQty       float64        `json:"order_qty"`
+	Side           string         `json:"side"`
+	Symbol         string         `json:"symbol"`
+	Token          string         `json:"token"`
+	Validate       bool           `json:"validate"`
+	Margin         bool           `json:"margin"`
+	TimeInForce    string         `json:"time_in_force"`
+	ExpireTime     string         `json:"expire_time"` /// RFC3339, for gtd
+	PostOnly       bool           `json:"post_only"`
+	ReduceOnly     bool           `json:"reduce_only"`
+	FeePreference  string         `json:"fee_preference"` /// base or quote (the default)
+	Triggers       *TriggerParams `json:"triggers"`
 }
 type OrderReq struct {
 	Method string      `json:"method"`
@@ -24,21 +39,52 @@ type Fee struct {
 	Qty   float64 `json:"qty"`
 }
 
+// / The state of an order's trigger, as reported on the executions channel
+type TriggerReport struct {
+	Reference   string  `json:"reference"`
+	Price       float64 `json:"price"`
+	PriceType   string  `json:"price_type"`
+	ActualPrice float64 `json:"actual_price,omitempty"` /// the trigger price the order is waiting for
+	PeakPrice   float64 `json:"peak_price,omitempty"`   /// trailing stops only
+	LastPrice   float64 `json:"last_price,omitempty"`   /// the reference price when last checked
+	Status      string  `json:"status"`                 /// untriggered or triggered
+	Timestamp   string  `json:"timestamp,omitempty"`    /// when it triggered
+}
+
 type Execution struct {
-	Cost         float64 `json:"cost"`
-	ExecId       string  `json:"exec_id"`
+	Cost         float64 `json:"cost,omitempty"`
+	ExecId       string  `json:"exec_id,omitempty"`
 	ExecType     string  `json:"exec_type"`
-	Fees         []Fee   `json:"fees"`
-	LiquidityInd string  `json:"liquidity_ind"`
+	Fees         []Fee   `json:"fees,omitempty"`
+	LiquidityInd string  `json:"liquidity_ind,omitempty"`
 	OrdType      string  `json:"ord_type"`
 	OrderId      string  `json:"order_id"`
-	LastQty      float64 `json:"last_qty"`
+	LastQty      float64 `json:"last_qty,omitempty"`
 	OrderUserref int64   `json:"order_userref"`
-	LastPrice    float64 `json:"last_price"`
+	ClOrdId      string  `json:"cl_ord_id,omitempty"`
+	LastPrice    float64 `json:"last_price,omitempty"`
 	Side         string  `json:"side"`
 	Symbol       string  `json:"symbol"`
 	Timestamp    string  `json:"timestamp"`
-	TradeId      int64   `json:"trade_id"`
+	TradeId      int64   `json:"trade_id,omitempty"`
+
+	/// the state of the order as of this report
+	OrderQty    float64        `json:"order_qty"`
+	LimitPrice  float64        `json:"limit_price,omitempty"`
+	OrderStatus string         `json:"order_status"`
+	TimeInForce string         `json:"time_in_force,omitempty"`
+	ExpireTime  string         `json:"expire_time,omitempty"`
+	Margin      bool           `json:"margin,omitempty"`
+	PostOnly    bool           `json:"post_only,omitempty"`
+	ReduceOnly  bool           `json:"reduce_only,omitempty"`
+	CumQty      float64        `json:"cum_qty"`
+	CumCost     float64        `json:"cum_cost"`
+	AvgPrice    float64        `json:"avg_price"`
+	LeavesQty   float64        `json:"leaves_qty"`
+	Amended     bool           `json:"amended,omitempty"`
+	Reason      string         `json:"reason,omitempty"`
+	Triggers    *TriggerReport `json:"triggers,omitempty"`
+	Liquidated  bool           `json:"liquidated,omitempty"`
 }
 
 func (p *Execution) Type() string {
@@ -61,17 +107,23 @@ type ExecMsg struct {
 }
 
 type CancelParams struct {
-	Orderuserref []int64 `json:"order_userref"`
+	OrderId      []string `json:"order_id"`
+	ClOrdId      []string `json:"cl_ord_id"`
+	Orderuserref []int64  `json:"order_userref"`
 }
 
 type CancelRequest struct {
 	Method string       `json:"method"`
 	Params CancelParams `json:"params"`
 	ReqId  int64        `json:"req_id"`
+
+	noexec bool /// hit by a noexec error rule, the orders stay open
 }
 
 type CancelResult struct {
-	Orderuserref int64 `json:"order_userref"`
+	OrderId      string `json:"order_id,omitempty"`
+	ClOrdId      string `json:"cl_ord_id,omitempty"`
+	Orderuserref int64  `json:"order_userref,omitempty"`
 }
 
 type CancelResp struct {
@@ -96,3 +148,154 @@ type OrderResp struct {
 	TimeIn  time.Time   `json:"time_in"`
 	TimeOut time.Time   `json:"time_out"`
 }
+
+// / Kraken's response to a request it refused
+type ErrorResp struct {
+	Error   string `json:"error"`
+	Method  string `json:"method"`
+	ReqId   int64  `json:"req_id,omitempty"`
+	Success bool   `json:"success"`
+	TimeIn  string `json:"time_in"`
+	TimeOut string `json:"time_out"`
+}
+
+// / batch_add - the orders take their symbol and validate from the batch
+type BatchAddParams struct {
+	Orders   []OrderParams `json:"orders"`
+	Symbol   string        `json:"symbol"`
+	Token    string        `json:"token"`
+	Validate bool          `json:"validate"`
+	Deadline string        `json:"deadline"`
+}
+
+type BatchAddReq struct {
+	Method string         `json:"method"`
+	Params BatchAddParams `json:"params"`
+	ReqId  int64          `json:"req_id"`
+}
+
+// / batch_cancel - orders can hold either order ids or order userrefs
+type BatchCancelParams struct {
+	Orders  []interface{} `json:"orders"`
+	ClOrdId []string      `json:"cl_ord_id"`
+	Token   string        `json:"token"`
+}
+
+type BatchCancelReq struct {
+	Method string            `json:"method"`
+	Params BatchCancelParams `json:"params"`
+	ReqId  int64             `json:"req_id"`
+}
+
+type BatchCancelResp struct {
+	Method          string `json:"method"`
+	OrdersCancelled int    `json:"orders_cancelled"`
+	ReqId           int64  `json:"req_id,omitempty"`
+	Success         bool   `json:"success"`
+	TimeIn          string `json:"time_in"`
+	TimeOut         string `json:"time_out"`
+}
+
+// / amend_order and edit_order - amend identifies the order by order_id (or cl_ord_id), edit by order_id
+type AmendParams struct {
+	OrderId      string  `json:"order_id"`
+	ClOrdId      string  `json:"cl_ord_id"`
+	OrderQty     float64 `json:"order_qty"`
+	LimitPrice   float64 `json:"limit_price"`
+	OrderUserref int64   `json:"order_userref"`
+	Symbol       string  `json:"symbol"`
+	Token        string  `json:"token"`
+	Validate     bool    `json:"validate"`
+}
+
+type AmendReq struct {
+	Method string      `json:"method"`
+	Params AmendParams `json:"params"`
+	ReqId  int64       `json:"req_id"`
+}
+
+type AmendResult struct {
+	AmendId         string `json:"amend_id,omitempty"`
+	OrderId         string `json:"order_id"`
+	ClOrdId         string `json:"cl_ord_id,omitempty"`
+	OriginalOrderId string `json:"original_order_id,omitempty"` /// edit_order only
+}
+
+type AmendResp struct {
+	Method  string      `json:"method"`
+	ReqId   int64       `json:"req_id,omitempty"`
+	Result  AmendResult `json:"result"`
+	Success bool        `json:"success"`
+	TimeIn  string      `json:"time_in"`
+	TimeOut string      `json:"time_out"`
+}
+
+type CancelAllResult struct {
+	Count int `json:"count"`
+}
+
+type CancelAllResp struct {
+	Method  string          `json:"method"`
+	ReqId   int64           `json:"req_id"`
+	Result  CancelAllResult `json:"result"`
+	Success bool            `json:"success"`
+	TimeIn  string          `json:"time_in"`
+	TimeOut string          `json:"time_out"`
+}
+
+type CancelAfterParams struct {
+	Timeout int64  `json:"timeout"` /// seconds, 0 disables
+	Token   string `json:"token"`
+}
+
+type CancelAfterReq struct {
+	Method string            `json:"method"`
+	Params CancelAfterParams `json:"params"`
+	ReqId  int64             `json:"req_id"`
+}
+
+// / An asset's balance in a balances channel snapshot
+type Balance struct {
+	Asset      string  `json:"asset"`
+	AssetClass string  `json:"asset_class"`
+	Balance    float64 `json:"balance"`
+}
+
+// / A change to an asset's balance in a balances channel update
+type LedgerEntry struct {
+	Asset      string  `json:"asset"`
+	AssetClass string  `json:"asset_class"`
+	Amount     float64 `json:"amount"`
+	Balance    float64 `json:"balance"`
+	Fee        float64 `json:"fee"`
+	LedgerId   string  `json:"ledger_id"`
+	RefId      string  `json:"ref_id"`
+	Timestamp  string  `json:"timestamp"`
+	Type       string  `json:"type"`
+	Category   string  `json:"category"`
+	WalletType string  `json:"wallet_type"`
+	WalletId   string  `json:"wallet_id"`
+}
+
+type BalancesMsg struct {
+	Channel  string      `json:"channel"`
+	Type     string      `json:"type"`
+	Data     interface{} `json:"data"` /// []Balance for a snapshot, []LedgerEntry for an update
+	Sequence int64       `json:"sequence"`
+}
+
+// / A margin call - Kraken's websocket has nothing for these, so the proxy sends them on a channel of its own
+type MarginCall struct {
+	Account     string  `json:"account"`
+	MarginLevel float64 `json:"margin_level"` /// equity as a % of used margin
+	Equity      float64 `json:"equity"`
+	UsedMargin  float64 `json:"used_margin"`
+	Collateral  float64 `json:"collateral"`
+	Timestamp   string  `json:"timestamp"`
+}
+
+type MarginCallMsg struct {
+	Channel string       `json:"channel"` /// always margin_call
+	Type    string       `json:"type"`
+	Data    []MarginCall `json:"data"`
+}
@@ -0,0 +1,252 @@
+package intercept
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"math/rand"
+	"time"
+)
+
+// / What an error rule does to the requests it hits
+const (
+	RULE_ERROR  = "error"  /// the request isn't sent, Kraken's error comes back instead (after Delay, if set)
+	RULE_DELAY  = "delay"  /// the response is held back for Delay, the executions aren't
+	RULE_DROP   = "drop"   /// the request takes effect but the response never comes back, as if it timed out
+	RULE_NOEXEC = "noexec" /// the response comes back but the request has no effect - add_order and cancel_order only
+
+	DEFAULT_RULE_ERROR = "EService:Unavailable"
+	RULE_HOLD          = time.Minute /// how long after the request to wait for responses to drop or delay
+)
+
+// / ErrorRule hits matching requests, all of them, every EveryNth or with Probability, and does Action to them
+type ErrorRule struct {
+	Method      string  /// add_order, cancel_order, batch_add ...
+	Symbol      string  /// any if empty
+	Side        string  /// any if empty
+	MinUserref  int64   /// any order_userref if both are 0
+	MaxUserref  int64   ///
+	EveryNth    int     /// hit every Nth matching request, 0 or 1 for all of them
+	Probability float64 /// the chance of hitting a matching request (after EveryNth), 0 for always
+	Action      string  /// see the RULE_ constants
+	Error       string  /// the error to respond with, defaults to DEFAULT_RULE_ERROR
+	Delay       string  /// e.g. "5s"
+
+	delay   time.Duration
+	matched int /// northbound thread only
+}
+
+func (p *ErrorRule) Expand() {
+	if p.Error == "" {
+		p.Error = DEFAULT_RULE_ERROR
+	}
+	if p.Delay != "" {
+		var err error
+		p.delay, err = time.ParseDuration(p.Delay)
+		handlers.PanicOnError(err)
+	}
+}
+
+func (p *ErrorRule) check() error {
+	switch p.Action {
+	case RULE_ERROR, RULE_DROP:
+	case RULE_DELAY:
+		if p.delay <= 0 {
+			return fmt.Errorf("error rule for %s needs a Delay to delay", p.Method)
+		}
+	case RULE_NOEXEC:
+		if p.Method != "add_order" && p.Method != "cancel_order" {
+			return fmt.Errorf("error rule action noexec is only for add_order and cancel_order, not %s", p.Method)
+		}
+	default:
+		return fmt.Errorf("unknown error rule action %s for %s", p.Action, p.Method)
+	}
+	return nil
+}
+
+// / ruleReq is what rules match on, order_userref is a list for cancel_order
+type ruleReq struct {
+	Method string `json:"method"`
+	ReqId  int64  `json:"req_id"`
+	Params struct {
+		Symbol       string      `json:"symbol"`
+		Side         string      `json:"side"`
+		OrderUserref interface{} `json:"order_userref"`
+	} `json:"params"`
+}
+
+func (p *ruleReq) userrefs() []int64 {
+	switch userref := p.Params.OrderUserref.(type) {
+	case float64:
+		return []int64{int64(userref)}
+	case []interface{}:
+		userrefs := make([]int64, 0, len(userref))
+		for _, ref := range userref {
+			if ref, ok := ref.(float64); ok {
+				userrefs = append(userrefs, int64(ref))
+			}
+		}
+		return userrefs
+	}
+	return nil
+}
+
+func (p *ErrorRule) matches(req *ruleReq) bool {
+	if p.Method != req.Method || (p.Symbol != "" && p.Symbol != req.Params.Symbol) ||
+		(p.Side != "" && p.Side != req.Params.Side) {
+		return false
+	}
+	if p.MinUserref == 0 && p.MaxUserref == 0 {
+		return true
+	}
+	for _, userref := range req.userrefs() {
+		if userref >= p.MinUserref && userref <= p.MaxUserref {
+			return true
+		}
+	}
+	return false
+}
+
+// / hit counts the matching request and decides whether this one is hit
+func (p *ErrorRule) hit() bool {
+	p.matched++
+	if p.EveryNth > 1 && p.matched%p.EveryNth != 0 {
+		return false
+	}
+	return p.Probability <= 0 || rand.Float64() < p.Probability
+}
+
+// / Responses are matched to requests by both, req_ids are only unique per method, if that
+type ruleKey struct {
+	method string
+	reqid  int64
+}
+
+// / A request hit by a drop or delay rule, waiting for its response(s). A nil rule means the request wasn't hit,
+// /   so anything held for an earlier request with the same key is let go.
+type ruleHit struct {
+	key      ruleKey
+	rule     *ErrorRule
+	at       time.Time
+	expected int /// the responses still to come, one unless a simulated cancel_order says otherwise
+}
+
+// / sendLater injects the response after the delay, unless the connection has gone by then
+func (p *TradeIntercept) sendLater(delay time.Duration, resp interface{}) {
+	p.afterfunc(delay, func() {
+		select {
+		case p.responses <- resp:
+		case <-p.done:
+		}
+	})
+}
+
+// / delayedResp is a held back response, already through the rules
+type delayedResp []byte
+
+func (p delayedResp) MarshalJSON() ([]byte, error) {
+	return p, nil
+}
+
+// / applyRules finds the first rule that hits the request, and returns it, nil if none does. Rules that act on
+// /   the response are passed to the southbound thread. Requests without a req_id can't be told apart from each
+// /   other's responses, so no rule applies to them. Northbound thread only.
+func (p *TradeIntercept) applyRules(msg []byte) *ErrorRule {
+	if len(p.errorrules) == 0 {
+		return nil
+	}
+	req := &ruleReq{}
+	if json.Unmarshal(msg, req) != nil || req.ReqId == 0 {
+		return nil
+	}
+	key := ruleKey{method: req.Method, reqid: req.ReqId}
+	held := false
+	for _, rule := range p.errorrules {
+		held = held || (rule.Method == req.Method && (rule.Action == RULE_DELAY || rule.Action == RULE_DROP))
+		if !rule.matches(req) || !rule.hit() {
+			continue
+		}
+		p.log("error rule ", rule.Action, " hit ", string(msg))
+		switch rule.Action {
+		case RULE_ERROR:
+			resp := &ErrorResp{
+				Error:   rule.Error,
+				Method:  req.Method,
+				ReqId:   req.ReqId,
+				Success: false,
+				TimeIn:  time.Now().Format(TIMEFORMAT),
+				TimeOut: time.Now().Format(TIMEFORMAT),
+			}
+			if rule.delay > 0 {
+				p.sendLater(rule.delay, resp)
+			} else {
+				p.responses <- resp
+			}
+		case RULE_DELAY, RULE_DROP:
+			p.rulehits <- &ruleHit{key: key, rule: rule, at: time.Now(), expected: 1}
+		}
+		return rule
+	}
+	if held {
+		///a reused req_id - this one's response goes through
+		p.rulehits <- &ruleHit{key: key}
+	}
+	return nil
+}
+
+// / handleRuleHits keeps the requests hit by drop and delay rules by method and req_id, until their responses
+// /   have come back or for as long as they might still
+func (p *TradeIntercept) handleRuleHits() {
+	for len(p.rulehits) > 0 {
+		rulehit := <-p.rulehits
+		if rulehit.rule == nil {
+			delete(p.heldreqs, rulehit.key)
+			continue
+		}
+		p.heldreqs[rulehit.key] = rulehit
+	}
+	for key, rulehit := range p.heldreqs {
+		if time.Since(rulehit.at) > RULE_HOLD {
+			delete(p.heldreqs, key)
+		}
+	}
+}
+
+// / expectResponses sets how many responses a held request gets, for the simulated cancel_order that answers
+// /   with one for each order. Southbound thread only.
+func (p *TradeIntercept) expectResponses(method string, reqid int64, count int) {
+	if rulehit, ok := p.heldreqs[ruleKey{method: method, reqid: reqid}]; ok {
+		rulehit.expected = count
+	}
+}
+
+// / holdResponse drops or delays a response to a request hit by a rule, otherwise it goes on its way.
+// /   Southbound thread only.
+func (p *TradeIntercept) holdResponse(msg []byte) (out []byte, forward bool) {
+	if len(p.heldreqs) == 0 {
+		return msg, true
+	}
+	resp := struct {
+		Method string `json:"method"`
+		ReqId  int64  `json:"req_id"`
+	}{}
+	if json.Unmarshal(msg, &resp) != nil || resp.Method == "" {
+		return msg, true
+	}
+	key := ruleKey{method: resp.Method, reqid: resp.ReqId}
+	rulehit, ok := p.heldreqs[key]
+	if !ok {
+		return msg, true
+	}
+	rulehit.expected--
+	if rulehit.expected <= 0 {
+		delete(p.heldreqs, key)
+	}
+	if rulehit.rule.Action == RULE_DELAY {
+		p.log("delaying ", string(msg))
+		p.sendLater(rulehit.rule.delay, delayedResp(msg))
+	} else {
+		p.log("dropping ", string(msg))
+	}
+	return msg, false
+}
@@ -0,0 +1,70 @@
+package intercept
+
+import (
+	"sort"
+)
+
+// / FeeTier is the maker and taker fee ratios once the account's 30 day volume reaches Volume
+type FeeTier struct {
+	Volume   float64
+	MakerFee float64
+	TakerFee float64
+}
+
+// / sortedTiers puts the tiers in order of volume, lowest first
+func sortedTiers(tiers []FeeTier) []FeeTier {
+	sorted := append([]FeeTier{}, tiers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Volume < sorted[j].Volume
+	})
+	return sorted
+}
+
+// / feeRatio is the fee for the fill given the account's volume so far
+func (p *TradeIntercept) feeRatio(taker bool) float64 {
+	makerfee, takerfee := p.makerfee, p.takerfee
+	if len(p.feetiers) > 0 {
+		volume := p.account.Volume()
+		for _, tier := range p.feetiers {
+			if volume < tier.Volume {
+				break
+			}
+			makerfee, takerfee = tier.MakerFee, tier.TakerFee
+		}
+	}
+	if taker {
+		return takerfee
+	}
+	return makerfee
+}
+
+// / Work out the cost and fees from the qty and price of the trade, in the asset the order prefers
+func (p *TradeIntercept) setCostAndFees(exec *Execution, order *Order) {
+	feeratio := p.feeRatio(exec.LiquidityInd == "t")
+	//// This is not clearly defined on Kraken docs ... but I think it should be how much we had to sell (whether its a buy or sell order)
+	///   of an asset to get the other asset
+	if exec.Side == "buy" {
+		///if we are buying, then the cost is the qty of the 1st currency
+		exec.Cost = (exec.LastQty) +
+			(exec.LastQty * feeratio)
+	} else {
+		///if we are selling, the cost is the qty of the 2nd currency
+		exec.Cost = (exec.LastQty * exec.LastPrice) +
+			(exec.LastQty * exec.LastPrice * feeratio)
+	}
+
+	base, quote := p.instruments.Assets(exec.Symbol)
+	fee := Fee{
+		Asset: quote,
+		/// qty of 1st * price of 2nd = qty of 2nd. qty of 2nd * fees ratio = total fees
+		Qty: exec.LastQty * exec.LastPrice * feeratio,
+	}
+	if order.FeePreference == "base" {
+		fee = Fee{
+			Asset: base,
+			Qty:   exec.LastQty * feeratio,
+		}
+	}
+	exec.Fees = []Fee{fee}
+	p.account.AddVolume(exec.LastQty * exec.LastPrice)
+}
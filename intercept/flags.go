@@ -0,0 +1,62 @@
+package intercept
+
+import (
+	"encoding/json"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"math"
+	"time"
+)
+
+const (
+	POST_ONLY_ERROR   = "EOrder:Post only order"
+	REDUCE_ONLY_ERROR = "EOrder:Reduce only:No position exists"
+)
+
+// / checkOrder returns the error Kraken would reject the order with, or "" if it can go ahead
+func (p *TradeIntercept) checkOrder(order *Order) string {
+	if reason := p.checkInstrument(order); reason != "" {
+		return reason
+	}
+	if reason := p.checkTimeInForce(order); reason != "" {
+		return reason
+	}
+	if reason := p.checkFlags(order); reason != "" {
+		return reason
+	}
+	if reason := p.checkFunds(order); reason != "" {
+		return reason
+	}
+	return p.checkMargin(order)
+}
+
+// / checkFlags returns the error Kraken would give the order for its post_only or reduce_only flags,
+// /   or "" if it can go ahead. A reduce_only order bigger than the position is cut down to the position.
+func (p *TradeIntercept) checkFlags(order *Order) string {
+	if order.PostOnly && !order.IsMarket() && !order.AwaitingTrigger() && p.bookDepth(order) > 0 {
+		///it would take liquidity
+		return POST_ONLY_ERROR
+	}
+	if order.ReduceOnly {
+		position := p.account.Position(order.Symbol)
+		if (order.Side == "buy" && position >= 0) || (order.Side == "sell" && position <= 0) {
+			return REDUCE_ONLY_ERROR
+		}
+		order.OrderQty = math.Min(order.OrderQty, math.Abs(position))
+	}
+	return ""
+}
+
+// / rejection replaces the upstream's response with Kraken's error
+func (p *TradeIntercept) rejection(method string, reqid int64, reason string) []byte {
+	timein := time.Now().Format(TIMEFORMAT)
+	msg, err := json.Marshal(&ErrorResp{
+		Error:   reason,
+		Method:  method,
+		ReqId:   reqid,
+		Success: false,
+		TimeIn:  timein,
+		TimeOut: time.Now().Format(TIMEFORMAT),
+	})
+	handlers.PanicOnError(err)
+	return msg
+}
@@ -0,0 +1,122 @@
+package intercept
+
+import (
+	"encoding/json"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// / IdGenerator makes the ids of the simulated orders and their executions
+type IdGenerator interface {
+	OrderId() string  /// e.g. OQCLML-BW3P3-BUCMWZ
+	ExecId() string   /// e.g. TNGMVH-SCRXO-QOVMVE
+	LedgerId() string /// e.g. LBPN3N-6FS5A-ED5BJY
+	AmendId() string
+	TradeId() int64 /// increasing
+}
+
+const IDCHARS = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// / KrakenIds makes ids the shape of Kraken's, the same ones every time for the same seed
+type KrakenIds struct {
+	rand    *rand.Rand
+	tradeid int64
+	lock    sync.Mutex
+}
+
+// / NewKrakenIds seeded with 0 uses the time, so the ids are different every run
+func NewKrakenIds(seed int64) *KrakenIds {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ids := &KrakenIds{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+	///somewhere a long way into the pair's trades, as it would be
+	ids.tradeid = 1000000 + ids.rand.Int63n(50000000)
+	return ids
+}
+
+// / id is the prefix and 5-5-6 random characters
+func (p *KrakenIds) id(prefix byte) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id := strings.Builder{}
+	id.WriteByte(prefix)
+	for i := 1; i < 19; i++ {
+		if i == 6 || i == 12 {
+			id.WriteByte('-')
+			continue
+		}
+		id.WriteByte(IDCHARS[p.rand.Intn(len(IDCHARS))])
+	}
+	return id.String()
+}
+
+func (p *KrakenIds) OrderId() string {
+	return p.id('O')
+}
+
+func (p *KrakenIds) ExecId() string {
+	return p.id('T')
+}
+
+func (p *KrakenIds) LedgerId() string {
+	return p.id('L')
+}
+
+func (p *KrakenIds) AmendId() string {
+	return p.id('T')
+}
+
+func (p *KrakenIds) TradeId() int64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.tradeid++
+	return p.tradeid
+}
+
+// / SetIdGenerator replaces the Kraken shaped ids, call it before any orders are placed
+func (p *TradeIntercept) SetIdGenerator(ids IdGenerator) {
+	p.ids = ids
+}
+
+// / withOrderIds puts our order ids in the add_order (a result) or batch_add (a list of results) response, the
+// /   validate only upstream doesn't have any
+func (p *TradeIntercept) withOrderIds(datamap map[string]interface{}, orders []*Order) []byte {
+	results := make([]interface{}, 0, len(orders))
+	switch result := datamap["result"].(type) {
+	case map[string]interface{}:
+		results = append(results, result)
+	case []interface{}:
+		results = result
+	}
+	for i, order := range orders {
+		if i >= len(results) {
+			results = append(results, make(map[string]interface{}))
+		}
+		result, ok := results[i].(map[string]interface{})
+		if !ok {
+			result = make(map[string]interface{})
+			results[i] = result
+		}
+		result["order_id"] = order.OrderId
+		if order.OrderUserref != 0 {
+			result["order_userref"] = order.OrderUserref
+		}
+		if order.ClOrdId != "" {
+			result["cl_ord_id"] = order.ClOrdId
+		}
+	}
+	if datamap["method"] == "batch_add" {
+		datamap["result"] = results
+	} else {
+		datamap["result"] = results[0]
+	}
+	msg, err := json.Marshal(datamap)
+	handlers.PanicOnError(err)
+	return msg
+}
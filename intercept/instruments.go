@@ -0,0 +1,68 @@
+package intercept
+
+// / Kraken's errors for orders that break the pair's rules
+const (
+	UNKNOWN_PAIR_ERROR   = "EQuery:Unknown asset pair"
+	PRICE_ERROR          = "EOrder:Invalid price"
+	VOLUME_ERROR         = "EGeneral:Invalid arguments:volume"
+	VOLUME_MINIMUM_ERROR = "EGeneral:Invalid arguments:volume minimum not met"
+	COST_MINIMUM_ERROR   = "EGeneral:Invalid arguments:cost minimum not met"
+	MARGIN_PAIR_ERROR    = "EOrder:Cannot open position"
+	ORDERS_LIMIT_ERROR   = "EOrder:Orders limit exceeded"
+)
+
+// / checkInstrument returns the error Kraken would reject the order with for breaking the pair's rules, or for
+// /   there being too many open orders on the pair, "" if it can go ahead
+func (p *TradeIntercept) checkInstrument(order *Order) string {
+	if reason := p.checkPair(order); reason != "" {
+		return reason
+	}
+	if p.maxopenorders > 0 && p.account.OpenOrders(order.Symbol) >= p.maxopenorders {
+		return ORDERS_LIMIT_ERROR
+	}
+	return ""
+}
+
+// / checkPair returns the error for the order's price or qty breaking the pair's rules. Nothing is checked until
+// /   some pairs are known, and pairs that aren't known aren't checked unless the registry is strict.
+func (p *TradeIntercept) checkPair(order *Order) string {
+	pair := p.instruments.Pair(order.Symbol)
+	if pair == nil && p.instruments.HasPairs() && p.instruments.Strict() {
+		return UNKNOWN_PAIR_ERROR
+	}
+	if pair != nil {
+		relativelimit := order.LimitPriceType != "" && order.LimitPriceType != "static"
+		if !order.IsMarket() && !relativelimit && !pair.ValidPrice(order.LimitPrice) {
+			return PRICE_ERROR
+		}
+		if order.Trigger != nil && !order.IsTrailing() && order.Trigger.PriceType == "static" &&
+			!pair.ValidPrice(order.Trigger.Price) {
+			return PRICE_ERROR
+		}
+		if !pair.ValidQty(order.OrderQty) {
+			return VOLUME_ERROR
+		}
+		if order.OrderQty < pair.QtyMin {
+			return VOLUME_MINIMUM_ERROR
+		}
+		price := order.LimitPrice
+		if order.IsMarket() || relativelimit {
+			price = p.markPrice(order.Symbol)
+		}
+		if price > 0 && order.OrderQty*price < pair.CostMin {
+			return COST_MINIMUM_ERROR
+		}
+		if order.Margin && !pair.Marginable {
+			return MARGIN_PAIR_ERROR
+		}
+	}
+	return ""
+}
+
+// / roundPrice rounds a price we worked out to the pair's price increment, if the pair is known
+func (p *TradeIntercept) roundPrice(symbol string, price float64) float64 {
+	if pair := p.instruments.Pair(symbol); pair != nil {
+		return pair.RoundPrice(price)
+	}
+	return price
+}
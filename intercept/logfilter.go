@@ -0,0 +1,99 @@
+package intercept
+
+import (
+	"errors"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"github.com/paul-at-nangalan/json-config/cfg"
+	"log"
+	"os"
+	"strings"
+)
+
+type Filter struct {
+	Matchon   string
+	FilterOut bool
+}
+
+type LogFilterCfg struct {
+	LogFilters []Filter
+}
+
+func (p *LogFilterCfg) Expand() {
+}
+
+// / LogFilter decides which messages the proxy logs, it never changes or drops a message
+type LogFilter struct {
+	logfilterin  []string
+	logfilterout []string
+}
+
+// / NewLogFilter reads the filters from log-filter.json, no file means no filters
+func NewLogFilter() *LogFilter {
+	logfiltercfg := LogFilterCfg{}
+	err := cfg.Read("log-filter", &logfiltercfg)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Println("No log-filter config", err)
+	} else {
+		handlers.PanicOnError(err)
+	}
+	tradeinterceptcfg := TradeInterceptCfg{}
+	if cfg.Read("trade-intercept", &tradeinterceptcfg) == nil {
+		legacyLogFilters(&logfiltercfg, &tradeinterceptcfg)
+	}
+
+	logfilterin := make([]string, 0)
+	logfilterout := make([]string, 0)
+	for _, filter := range logfiltercfg.LogFilters {
+		if filter.FilterOut {
+			logfilterout = append(logfilterout, filter.Matchon)
+		} else {
+			logfilterin = append(logfilterin, filter.Matchon)
+		}
+	}
+	return &LogFilter{
+		logfilterin:  logfilterin,
+		logfilterout: logfilterout,
+	}
+}
+
+// / legacyLogFilters picks up LogFilters from trade-intercept.json, where they were before they moved to
+// /   log-filter.json, so configs that still have them keep filtering
+func legacyLogFilters(logfiltercfg *LogFilterCfg, tradeinterceptcfg *TradeInterceptCfg) {
+	if len(tradeinterceptcfg.LogFilters) == 0 {
+		return
+	}
+	if len(logfiltercfg.LogFilters) == 0 {
+		log.Println("WARNING: LogFilters in trade-intercept.json have moved to log-filter.json, using them from",
+			"trade-intercept.json")
+		logfiltercfg.LogFilters = tradeinterceptcfg.LogFilters
+		return
+	}
+	log.Println("WARNING: ignoring LogFilters in trade-intercept.json, using the ones in log-filter.json")
+}
+
+func (p *LogFilter) Northbound(msg []byte) (out []byte, forward bool) {
+	return msg, true
+}
+
+func (p *LogFilter) Southbound(msg []byte) (out []byte, forward bool) {
+	return msg, true
+}
+
+func (p *LogFilter) InjectSouth() (msg []byte) {
+	return nil
+}
+
+func (p *LogFilter) CheckFilters(msg []byte) bool {
+	for _, filter := range p.logfilterin {
+		if strings.Contains(string(msg), filter) {
+			return true
+		}
+	}
+	for _, filter := range p.logfilterout {
+		if strings.Contains(string(msg), filter) {
+			return false
+		}
+
+	}
+	return true
+}
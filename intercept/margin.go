@@ -0,0 +1,107 @@
+package intercept
+
+import (
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	MARGIN_ERROR = "EOrder:Insufficient margin"
+)
+
+// / markPrice is what margin positions are valued at - the mid price, else the last trade, 0 if there's neither
+func (p *TradeIntercept) markPrice(symbol string) float64 {
+	orderbook := p.orderbooks.GetOrderbook(symbol)
+	if mid := orderbook.MidPrice(); mid > 0 {
+		return mid
+	}
+	return orderbook.LastPrice()
+}
+
+// / checkMargin returns Kraken's insufficient margin error if the free margin won't cover what the order opens.
+// /   The part of the order that reduces the position needs no margin.
+func (p *TradeIntercept) checkMargin(order *Order) string {
+	if !p.account.SimulatesMargin() || order.ReduceOnly {
+		return ""
+	}
+	opens := order.LeavesQty()
+	position := p.account.Position(order.Symbol)
+	if (order.Side == "buy" && position < 0) || (order.Side == "sell" && position > 0) {
+		opens = math.Max(0, opens-math.Abs(position))
+	}
+	price := order.LimitPrice
+	if order.IsMarket() || price <= 0 {
+		price = p.markPrice(order.Symbol)
+	}
+	if opens <= 0 || price <= 0 {
+		return ""
+	}
+	///a little slack for rounding
+	if opens*price/p.account.Leverage() > p.account.FreeMargin(p.markPrice)+1e-9 {
+		return MARGIN_ERROR
+	}
+	return ""
+}
+
+// / checkPositions charges rollover on the margin positions, makes margin calls and liquidates when the margin
+// /   level falls far enough. Only connections that have traded on margin look after the positions, so the
+// /   margin calls and liquidation reports go somewhere they'll be seen.
+func (p *TradeIntercept) checkPositions() {
+	if !p.margintraded || !p.account.SimulatesMargin() {
+		return
+	}
+	if charged := p.account.ChargeRollover(time.Now()); charged > 0 {
+		p.log("charged rollover of ", charged, " on account ", p.account.Name)
+	}
+	status, margincall, liquidate := p.account.CheckMargin(p.markPrice)
+	if margincall {
+		log.Println("WARNING: margin call on account ", p.account.Name, ", margin level ", status.Level,
+			"%, equity ", status.Equity, ", used margin ", status.Used)
+		p.responses <- &MarginCallMsg{
+			Channel: "margin_call",
+			Type:    "update",
+			Data: []MarginCall{{
+				Account:     p.account.Name,
+				MarginLevel: status.Level,
+				Equity:      status.Equity,
+				UsedMargin:  status.Used,
+				Collateral:  status.Collateral,
+				Timestamp:   time.Now().Format(TIMEFORMAT),
+			}},
+		}
+	}
+	for _, position := range liquidate {
+		p.liquidate(position.Symbol, position.Qty, position.AvgPrice)
+	}
+}
+
+// / liquidate closes the position at the mark price with a market order of our own, as Kraken would
+func (p *TradeIntercept) liquidate(symbol string, qty float64, avgprice float64) {
+	p.liquidationid++
+	side := "sell"
+	if qty < 0 {
+		side = "buy"
+	}
+	order := &Order{
+		OrderId:      p.ids.OrderId(),
+		OrderUserref: -p.liquidationid,
+		Symbol:       symbol,
+		Side:         side,
+		OrderType:    MARKET,
+		OrderQty:     math.Abs(qty),
+		TimeInForce:  IOC,
+		Margin:       true,
+		Liquidated:   true,
+		Taker:        true,
+		Status:       PENDING_NEW,
+	}
+	log.Println("WARNING: liquidating ", qty, " ", symbol, " on account ", p.account.Name)
+	price := p.markPrice(symbol)
+	if price <= 0 {
+		price = avgprice
+	}
+	p.pendingtrades.add(order)
+	p.acceptOrder(order)
+	p.fill(order, order.OrderQty, price)
+}
@@ -0,0 +1,37 @@
+package intercept
+
+// / processTrades feeds public trade prints to the queues. The snapshot is history, so it is skipped.
+func (p *TradeIntercept) processTrades(datamap map[string]interface{}) {
+	if datamap["type"] != "update" {
+		return
+	}
+	trades, _ := datamap["data"].([]interface{})
+	for _, trade := range trades {
+		trademap, ok := trade.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		symbol, _ := trademap["symbol"].(string)
+		side, _ := trademap["side"].(string)
+		price, _ := trademap["price"].(float64)
+		qty, _ := trademap["qty"].(float64)
+		tradeid, _ := trademap["trade_id"].(float64)
+		p.orderbooks.GetOrderbook(symbol).AddTrade(side, price, qty, int64(tradeid))
+	}
+}
+
+// / processTicker keeps the last price up to date between prints, for triggers
+func (p *TradeIntercept) processTicker(datamap map[string]interface{}) {
+	tickers, _ := datamap["data"].([]interface{})
+	for _, ticker := range tickers {
+		tickermap, ok := ticker.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		symbol, _ := tickermap["symbol"].(string)
+		last, _ := tickermap["last"].(float64)
+		if last > 0 {
+			p.orderbooks.GetOrderbook(symbol).SetLastPrice(last)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package intercept
+
+import (
+	"encoding/json"
+	"github.com/paul-at-nangalan/errorhandler/handlers"
+	"github.com/paul-at-nangalan/json-config/cfg"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	GUARD_ERROR = "EGeneral:Invalid arguments:validate must be true, live orders are blocked by the test proxy"
+)
+
+type OrderGuardCfg struct {
+	/// Setting this lets orders without validate through to Kraken, where they WILL be placed for real
+	DangerAllowLiveOrders bool `json:"DANGER_ALLOW_LIVE_ORDERS"`
+}
+
+func (p *OrderGuardCfg) Expand() {
+}
+
+// / OrderGuard stops any order that has not set validate from reaching the real exchange,
+// /   answering it with an error instead
+type OrderGuard struct {
+	enabled   bool
+	responses chan []byte
+}
+
+// / live should be true when the upstream is the real exchange, otherwise there is nothing to guard against
+func NewOrderGuard(live bool) *OrderGuard {
+	orderguardcfg := OrderGuardCfg{}
+	err := cfg.Read("order-guard", &orderguardcfg)
+	handlers.PanicOnError(err)
+
+	if live && orderguardcfg.DangerAllowLiveOrders {
+		log.Println("WARNING: DANGER_ALLOW_LIVE_ORDERS is set - orders without validate WILL be placed on the real exchange")
+	}
+	return &OrderGuard{
+		enabled:   live && !orderguardcfg.DangerAllowLiveOrders,
+		responses: make(chan []byte, 100),
+	}
+}
+
+// / The requests that place or change orders
+var ordermethods = []string{"add_order", "amend_order", "edit_order", "batch_add"}
+
+func isOrderMethod(method string) bool {
+	for _, ordermethod := range ordermethods {
+		if strings.EqualFold(method, ordermethod) {
+			return true
+		}
+	}
+	return false
+}
+
+// / values returns the values of every key matching key, ignoring case as encoding/json does, so neither a key
+// /   in a different case nor a second copy of it can slip past
+func values(datamap map[string]interface{}, key string) []interface{} {
+	vals := make([]interface{}, 0, 1)
+	for k, val := range datamap {
+		if strings.EqualFold(k, key) {
+			vals = append(vals, val)
+		}
+	}
+	return vals
+}
+
+// / orderMethod returns the order method the request is for, "" if it isn't one
+func orderMethod(req map[string]interface{}) string {
+	for _, val := range values(req, "method") {
+		if method, _ := val.(string); isOrderMethod(method) {
+			return method
+		}
+	}
+	return ""
+}
+
+// / validated is true only if the request's params are an object, and every validate in them is true
+func validated(req map[string]interface{}) bool {
+	paramslist := values(req, "params")
+	if len(paramslist) == 0 {
+		return false
+	}
+	for _, val := range paramslist {
+		params, ok := val.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		validates := values(params, "validate")
+		if len(validates) == 0 {
+			return false
+		}
+		for _, validate := range validates {
+			if validate != true {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// / Only requests that can be shown to be something other than an order, or an order with validate true, go
+// /   upstream. The request is decoded loosely, so an odd req_id or params can't get an order past the guard.
+func (p *OrderGuard) Northbound(msg []byte) (out []byte, forward bool) {
+	if !p.enabled {
+		return msg, true
+	}
+	timein := time.Now().UTC()
+	req := make(map[string]interface{})
+	method := ""
+	if err := json.Unmarshal(msg, &req); err != nil {
+		///not something we understand, block it if it could be an order
+		lower := strings.ToLower(string(msg))
+		couldbe := false
+		for _, ordermethod := range ordermethods {
+			couldbe = couldbe || strings.Contains(lower, ordermethod)
+		}
+		if !couldbe {
+			return msg, true
+		}
+	} else {
+		method = orderMethod(req)
+		if method == "" || validated(req) {
+			return msg, true
+		}
+	}
+
+	log.Println("ALARM: blocked live", method, "without validate set:", string(msg))
+	errresp := map[string]interface{}{
+		"error":    GUARD_ERROR,
+		"method":   method,
+		"success":  false,
+		"time_in":  timein.Format(TIMEFORMAT),
+		"time_out": time.Now().UTC().Format(TIMEFORMAT),
+	}
+	///echoed back as it was sent, whatever it is
+	if reqid, ok := req["req_id"]; ok {
+		errresp["req_id"] = reqid
+	}
+	resp, err := json.Marshal(errresp)
+	handlers.PanicOnError(err)
+	p.responses <- resp
+	return msg, false
+}
+
+func (p *OrderGuard) Southbound(msg []byte) (out []byte, forward bool) {
+	return msg, true
+}
+
+func (p *OrderGuard) InjectSouth() (msg []byte) {
+	if len(p.responses) > 0 {
+		return <-p.responses
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package intercept
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/paul-at-nangalan/json-config/cfg"
+	"github.com/stretchr/testify/assert"
+)
+
+// / setupCfg points the config at a temp dir holding the given files
+func setupCfg(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+	for name, contents := range files {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name+".json"), []byte(contents), 0644))
+	}
+	cfg.Setup(dir)
+}
+
+func TestOrderGuard(t *testing.T) {
+	setupCfg(t, map[string]string{"order-guard": `{"DANGER_ALLOW_LIVE_ORDERS": false}`})
+	guard := NewOrderGuard(true)
+
+	_, forward := guard.Northbound([]byte(`{"method":"add_order","req_id":3,"params":{"validate":true,"order_qty":1}}`))
+	assert.True(t, forward)
+	_, forward = guard.Northbound([]byte(`{"method":"subscribe","params":{"channel":"executions"}}`))
+	assert.True(t, forward)
+	assert.Nil(t, guard.InjectSouth())
+
+	for _, method := range []string{"add_order", "amend_order", "edit_order", "batch_add"} {
+		_, forward = guard.Northbound([]byte(`{"method":"` + method + `","req_id":4,"params":{"validate":false}}`))
+		assert.False(t, forward)
+		resp := ErrorResp{}
+		assert.Nil(t, json.Unmarshal(guard.InjectSouth(), &resp))
+		assert.Equal(t, method, resp.Method)
+		assert.Equal(t, int64(4), resp.ReqId)
+		assert.False(t, resp.Success)
+		assert.Equal(t, GUARD_ERROR, resp.Error)
+	}
+	_, forward = guard.Northbound([]byte(`{"method":"add_order","req_id":5,"params":{}}`))
+	assert.False(t, forward)
+	guard.InjectSouth()
+
+	///odd req_ids and params can't get an order past, and the req_id is echoed back as it was sent
+	for _, test := range []struct {
+		msg   string
+		reqid interface{}
+	}{
+		{`{"method":"add_order","req_id":"6","params":{"order_qty":1}}`, "6"},
+		{`{"method":"add_order","req_id":6.5,"params":{"order_qty":1}}`, 6.5},
+		{`{"method":"add_order","req_id":7,"params":[{"validate":true}]}`, 7.0},
+		{`{"method":"add_order","req_id":8,"params":{"validate":"true"}}`, 8.0},
+		{`{"method":"add_order","req_id":9,"params":{"Validate":false,"validate":true}}`, 9.0},
+		{`{"Method":"add_order","req_id":10,"params":{"order_qty":1}}`, 10.0},
+		{`{"method":"batch_add","params":{"orders":[{"order_qty":1}]}}`, nil},
+		{`[{"method":"add_order","params":{"order_qty":1}}]`, nil},
+	} {
+		_, forward = guard.Northbound([]byte(test.msg))
+		assert.False(t, forward, test.msg)
+		resp := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(guard.InjectSouth(), &resp))
+		assert.Equal(t, GUARD_ERROR, resp["error"], test.msg)
+		assert.Equal(t, test.reqid, resp["req_id"], test.msg)
+	}
+	///anything that isn't an order still goes through, understood or not
+	_, forward = guard.Northbound([]byte(`{"method":"ping","req_id":"x"}`))
+	assert.True(t, forward)
+	_, forward = guard.Northbound([]byte(`not json`))
+	assert.True(t, forward)
+	assert.Nil(t, guard.InjectSouth())
+
+	///Nothing to guard against if the upstream is not the real exchange
+	guard = NewOrderGuard(false)
+	_, forward = guard.Northbound([]byte(`{"method":"add_order","req_id":5,"params":{}}`))
+	assert.True(t, forward)
+
+	setupCfg(t, map[string]string{"order-guard": `{"DANGER_ALLOW_LIVE_ORDERS": true}`})
+	guard = NewOrderGuard(true)
+	_, forward = guard.Northbound([]byte(`{"method":"add_order","req_id":5,"params":{}}`))
+	assert.True(t, forward)
+}
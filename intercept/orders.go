@@ -0,0 +1,295 @@
+package intercept
+
+import (
+	orderbooks2 "kraken-test-proxy-v2/orderbooks"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	PENDING_NEW      = "pending_new"
+	NEW              = "new"
+	PARTIALLY_FILLED = "partially_filled"
+	FILLED           = "filled"
+	CANCELED         = "canceled"
+	EXPIRED          = "expired"
+)
+
+const (
+	LIMIT               = "limit"
+	MARKET              = "market"
+	STOP_LOSS           = "stop-loss"
+	STOP_LOSS_LIMIT     = "stop-loss-limit"
+	TAKE_PROFIT         = "take-profit"
+	TAKE_PROFIT_LIMIT   = "take-profit-limit"
+	TRAILING_STOP       = "trailing-stop"
+	TRAILING_STOP_LIMIT = "trailing-stop-limit"
+)
+
+// / Order is the simulated state of an order, the execution reports are generated from it
+type Order struct {
+	OrderId      string
+	OrderUserref int64
+	ClOrdId      string
+	ReqId        int64
+	Symbol       string
+	Side         string
+	OrderType    string
+	OrderQty     float64
+	LimitPrice   float64
+	TimeInForce  string
+	Margin       bool
+
+	LimitPriceType string   /// how to work out the limit price from the trigger price
+	Trigger        *Trigger /// nil unless it is a stop-loss, take-profit or trailing-stop
+	ExpireTime     time.Time
+	PostOnly       bool
+	ReduceOnly     bool
+	FeePreference  string
+
+	Taker      bool /// fills are taker fills - it took liquidity when it went live, or is a market order
+	Liquidated bool /// our own order closing a margin position that fell to the liquidation level
+
+	Status  string
+	CumQty  float64
+	CumCost float64 /// qty * price summed over the fills
+
+	queue       *orderbooks2.QueuePosition /// where we are in the queue at our price, nil if not matching the book
+	printcursor int64                      /// the next public trade print to match against, in the trades fill mode
+	expiry      timer                      /// gtd orders only
+	batch       bool                       /// from batch_add, so matched to its response by pendingbatches
+	counted     bool                       /// in the account's open orders
+	badexpiry   bool                       /// expire_time was given but isn't a time
+}
+
+func NewOrder(orderreq *OrderReq, orderid string) *Order {
+	ordertype := orderreq.Params.OrderType
+	if ordertype == "" {
+		ordertype = LIMIT
+	}
+	timeinforce := strings.ToLower(orderreq.Params.TimeInForce)
+	if timeinforce == "" {
+		timeinforce = GTC
+	}
+	order := &Order{
+		OrderId:      orderid,
+		OrderUserref: orderreq.Params.OrderUserref,
+		ClOrdId:      orderreq.Params.ClOrdId,
+		ReqId:        orderreq.ReqId,
+		Symbol:       orderreq.Params.Symbol,
+		Side:         orderreq.Params.Side,
+		OrderType:    ordertype,
+		OrderQty:     orderreq.Params.OrderQty,
+		LimitPrice:   orderreq.Params.LimitPrice,
+		TimeInForce:  timeinforce,
+		Margin:       orderreq.Params.Margin,
+		Status:       PENDING_NEW,
+
+		LimitPriceType: orderreq.Params.LimitPriceType,
+		PostOnly:       orderreq.Params.PostOnly,
+		ReduceOnly:     orderreq.Params.ReduceOnly,
+		FeePreference:  orderreq.Params.FeePreference,
+	}
+	if orderreq.Params.ExpireTime != "" {
+		///Kraken rejects a bad expire_time, checkTimeInForce does the same
+		var err error
+		order.ExpireTime, err = time.Parse(time.RFC3339Nano, orderreq.Params.ExpireTime)
+		order.badexpiry = err != nil
+	}
+	if order.IsTrailing() || strings.HasPrefix(ordertype, STOP_LOSS) || order.IsTakeProfit() {
+		order.Trigger = NewTrigger(orderreq.Params.Triggers)
+	}
+	return order
+}
+
+func (p *Order) LeavesQty() float64 {
+	leaves := p.OrderQty - p.CumQty
+	if leaves < 0 {
+		return 0
+	}
+	return leaves
+}
+
+func (p *Order) AvgPrice() float64 {
+	if p.CumQty == 0 {
+		return 0
+	}
+	return p.CumCost / p.CumQty
+}
+
+// / IsOpen is true once the order has been accepted and until it is done with
+func (p *Order) IsOpen() bool {
+	return p.Status == NEW || p.Status == PARTIALLY_FILLED
+}
+
+// / IsMarket is true for orders that take whatever the book has once they are triggered
+func (p *Order) IsMarket() bool {
+	switch p.OrderType {
+	case MARKET, STOP_LOSS, TAKE_PROFIT, TRAILING_STOP:
+		return true
+	}
+	return false
+}
+
+func (p *Order) IsTrailing() bool {
+	return strings.HasPrefix(p.OrderType, TRAILING_STOP)
+}
+
+func (p *Order) IsTakeProfit() bool {
+	return strings.HasPrefix(p.OrderType, TAKE_PROFIT)
+}
+
+func (p *Order) AwaitingTrigger() bool {
+	return p.Trigger != nil && p.Trigger.Status == UNTRIGGERED
+}
+
+// / WalkPrice is the worst price the order will take from the book
+func (p *Order) WalkPrice() float64 {
+	if !p.IsMarket() {
+		return p.LimitPrice
+	}
+	if p.Side == "buy" {
+		return math.Inf(1)
+	}
+	return 0
+}
+
+// / orderReport is an execution report of the order's current state
+func (p *TradeIntercept) orderReport(order *Order, exectype string) *Execution {
+	var triggers *TriggerReport
+	if order.Trigger != nil {
+		triggers = order.Trigger.report()
+	}
+	expiretime := ""
+	if !order.ExpireTime.IsZero() {
+		expiretime = order.ExpireTime.Format(TIMEFORMAT)
+	}
+	return &Execution{
+		ExecType:     exectype,
+		OrdType:      order.OrderType,
+		OrderId:      order.OrderId,
+		OrderUserref: order.OrderUserref,
+		ClOrdId:      order.ClOrdId,
+		Side:         order.Side,
+		Symbol:       order.Symbol,
+		Timestamp:    time.Now().Format(TIMEFORMAT),
+		OrderQty:     order.OrderQty,
+		LimitPrice:   order.LimitPrice,
+		OrderStatus:  order.Status,
+		TimeInForce:  order.TimeInForce,
+		ExpireTime:   expiretime,
+		Margin:       order.Margin,
+		PostOnly:     order.PostOnly,
+		ReduceOnly:   order.ReduceOnly,
+		CumQty:       order.CumQty,
+		CumCost:      order.CumCost,
+		AvgPrice:     order.AvgPrice(),
+		LeavesQty:    order.LeavesQty(),
+		Triggers:     triggers,
+		Liquidated:   order.Liquidated,
+	}
+}
+
+// / accept the order, reporting pending_new then new, and start matching it
+func (p *TradeIntercept) acceptOrder(order *Order) {
+	pendingnew := p.orderReport(order, PENDING_NEW)
+	order.Status = NEW
+	p.account.OrderOpened(order.Symbol)
+	order.counted = true
+	p.holdFunds(order)
+	p.traderesp <- []*Execution{pendingnew, p.orderReport(order, NEW)}
+	p.startExpiry(order)
+	p.joinQueue(order)
+	p.watchPrints(order)
+}
+
+// / fillImmediate is the immediate fill mode - limit orders fill in full at their price, orders waiting for a
+// /   trigger wait. Market orders never get here, they take what the book has once and the rest is canceled.
+func (p *TradeIntercept) fillImmediate(order *Order) {
+	if order.AwaitingTrigger() {
+		return
+	}
+	p.fill(order, order.LeavesQty(), order.LimitPrice)
+}
+
+// / walkBook fills as much of the order as the book allows, a level at a time at each level's price
+func (p *TradeIntercept) walkBook(order *Order) {
+	orderbook := p.orderbooks.GetOrderbook(order.Symbol)
+	var fills []orderbooks2.Fill
+	if order.Side == "buy" {
+		fills = orderbook.WalkAsks(order.WalkPrice(), order.LeavesQty())
+	} else {
+		fills = orderbook.WalkBids(order.WalkPrice(), order.LeavesQty())
+	}
+	for _, fill := range fills {
+		p.fill(order, fill.Qty, fill.Price)
+	}
+}
+
+// / fill some (or all) of the order at price, reporting the trade, and filled once there's nothing left
+func (p *TradeIntercept) fill(order *Order, qty float64, price float64) {
+	if qty > order.LeavesQty() {
+		qty = order.LeavesQty()
+	}
+	if qty <= 0 {
+		return
+	}
+	order.CumQty += qty
+	order.CumCost += qty * price
+	if order.Margin {
+		///the fee comes off the collateral in the quote currency, whatever the fee preference
+		p.account.AddMarginTrade(order.Symbol, order.Side, qty, price, qty*price*p.feeRatio(order.Taker))
+		p.margintraded = true
+	}
+	order.Status = PARTIALLY_FILLED
+	if order.LeavesQty() <= 0 {
+		order.Status = FILLED
+	}
+	p.holdFunds(order)
+
+	trade := p.orderReport(order, "trade")
+	trade.ExecId = p.ids.ExecId()
+	trade.TradeId = p.ids.TradeId()
+	trade.LastQty = qty
+	trade.LastPrice = price
+	trade.LiquidityInd = "m"
+	if order.Taker {
+		trade.LiquidityInd = "t"
+	}
+	p.setCostAndFees(trade, order)
+	p.moveFunds(trade, order)
+	p.msgreplay.AddMessage(trade)
+
+	reports := []*Execution{trade}
+	if order.Status == FILLED {
+		p.leaveQueue(order)
+		p.stopExpiry(order)
+		reports = append(reports, p.orderReport(order, FILLED))
+		p.retire(order)
+	}
+	p.traderesp <- reports
+}
+
+// / finish the order off as canceled or expired
+func (p *TradeIntercept) closeOrder(order *Order, status string, reason string) *Execution {
+	p.log("closing order ", order.OrderUserref, " ", order.OrderId, " ", status, " ", reason)
+	order.Status = status
+	p.leaveQueue(order)
+	p.stopExpiry(order)
+	p.retire(order)
+	report := p.orderReport(order, status)
+	report.Reason = reason
+	return report
+}
+
+// / retire moves the order from the pending trades to the past trades
+func (p *TradeIntercept) retire(order *Order) {
+	if order.counted {
+		p.account.OrderClosed(order.Symbol)
+		order.counted = false
+	}
+	p.account.Release(order.OrderId)
+	p.pendingtrades.remove(order)
+	p.pastrtrades.add(order)
+}
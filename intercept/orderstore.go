@@ -0,0 +1,117 @@
+package intercept
+
+const (
+	MAXPASTORDERS = 1000 /// how many finished orders are kept, to look up by their ids
+)
+
+// / orderStore holds orders oldest first, indexed by order_id, cl_ord_id and order_userref. Userrefs needn't be
+// /   unique, and orders without one (0) aren't indexed by it. Southbound thread only.
+type orderStore struct {
+	orders    []*Order
+	byorderid map[string]*Order
+	byclordid map[string]*Order
+	byuserref map[int64][]*Order
+	limit     int /// drop the oldest beyond this many, 0 for no limit
+}
+
+func newOrderStore(limit int) *orderStore {
+	return &orderStore{
+		byorderid: make(map[string]*Order),
+		byclordid: make(map[string]*Order),
+		byuserref: make(map[int64][]*Order),
+		limit:     limit,
+	}
+}
+
+func (p *orderStore) add(order *Order) {
+	p.orders = append(p.orders, order)
+	p.index(order)
+	if p.limit > 0 && len(p.orders) > p.limit {
+		p.remove(p.orders[0])
+	}
+}
+
+func (p *orderStore) index(order *Order) {
+	p.byorderid[order.OrderId] = order
+	if order.ClOrdId != "" {
+		p.byclordid[order.ClOrdId] = order
+	}
+	if order.OrderUserref != 0 {
+		p.byuserref[order.OrderUserref] = append(p.byuserref[order.OrderUserref], order)
+	}
+}
+
+func (p *orderStore) unindex(order *Order) {
+	if p.byorderid[order.OrderId] == order {
+		delete(p.byorderid, order.OrderId)
+	}
+	if p.byclordid[order.ClOrdId] == order {
+		delete(p.byclordid, order.ClOrdId)
+	}
+	userrefs := p.byuserref[order.OrderUserref]
+	for i, other := range userrefs {
+		if other == order {
+			userrefs = append(userrefs[:i:i], userrefs[i+1:]...)
+			break
+		}
+	}
+	if len(userrefs) == 0 {
+		delete(p.byuserref, order.OrderUserref)
+	} else {
+		p.byuserref[order.OrderUserref] = userrefs
+	}
+}
+
+// / remove returns false if the order isn't in the store
+func (p *orderStore) remove(order *Order) bool {
+	for i, other := range p.orders {
+		if other == order {
+			p.orders = append(p.orders[:i:i], p.orders[i+1:]...)
+			p.unindex(order)
+			return true
+		}
+	}
+	return false
+}
+
+// / reindex is for changing the order's ids, e.g. edit_order gives it a new order_id and maybe userref
+func (p *orderStore) reindex(order *Order, change func()) {
+	p.unindex(order)
+	change()
+	p.index(order)
+}
+
+// / all is a copy, so orders can come and go while going through it
+func (p *orderStore) all() []*Order {
+	orders := make([]*Order, len(p.orders))
+	copy(orders, p.orders)
+	return orders
+}
+
+func (p *orderStore) len() int {
+	return len(p.orders)
+}
+
+// / get returns the order with the order_id, nil if there isn't one
+func (p *orderStore) get(orderid string) *Order {
+	return p.byorderid[orderid]
+}
+
+func (p *orderStore) getByClOrdId(clordid string) *Order {
+	return p.byclordid[clordid]
+}
+
+func (p *orderStore) getByUserref(userref int64) []*Order {
+	return p.byuserref[userref]
+}
+
+// / find returns the order by order_id, or cl_ord_id if there's no order_id, nil if there isn't one
+func (p *orderStore) find(orderid string, clordid string) *Order {
+	if orderid != "" {
+		return p.get(orderid)
+	}
+	if clordid != "" {
+		return p.getByClOrdId(clordid)
+	}
+	return nil
+}
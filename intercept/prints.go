@@ -0,0 +1,38 @@
+package intercept
+
+// / In the trades fill mode, orders fill against the public trade prints seen after they were accepted.
+// /   A buy fills when a print is at or below its price, a sell at or above, at the order's price and for no
+// /   more than what is left of the print's qty - the orders on every connection share it, first come first served.
+
+func (p *TradeIntercept) watchPrints(order *Order) {
+	if p.fillmode != FILL_TRADES || !order.IsOpen() || order.IsMarket() || order.AwaitingTrigger() {
+		return
+	}
+	order.printcursor = p.orderbooks.GetOrderbook(order.Symbol).PrintCursor()
+}
+
+func (p *TradeIntercept) matchPrints(order *Order) {
+	if !order.IsOpen() {
+		return
+	}
+	orderbook := p.orderbooks.GetOrderbook(order.Symbol)
+	prints, cursor := orderbook.PrintsSince(order.printcursor)
+	order.printcursor = cursor
+	first := cursor - int64(len(prints))
+	///prints trade through a resting order, so it is the maker
+	order.Taker = false
+	for i, trade := range prints {
+		if !order.IsOpen() {
+			return
+		}
+		if (order.Side == "buy" && trade.Price <= order.LimitPrice) ||
+			(order.Side == "sell" && trade.Price >= order.LimitPrice) {
+			qty := orderbook.TakePrint(first+int64(i), order.LeavesQty())
+			if qty <= 0 {
+				continue
+			}
+			p.log("print fill for ", order.OrderUserref, " ", qty, " @ ", trade.Price)
+			p.fill(order, qty, order.LimitPrice)
+		}
+	}
+}
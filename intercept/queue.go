@@ -0,0 +1,31 @@
+package intercept
+
+// / Passive orders join the queue at their price in the shared book, and fill as public trade prints
+// /   work through the queue in front of them
+
+func (p *TradeIntercept) joinQueue(order *Order) {
+	if p.fillmode != FILL_ORDERBOOK || !order.IsOpen() || order.IsMarket() || order.AwaitingTrigger() {
+		return
+	}
+	order.queue = p.orderbooks.GetOrderbook(order.Symbol).JoinQueue(order.Side, order.LimitPrice, order.LeavesQty())
+}
+
+func (p *TradeIntercept) leaveQueue(order *Order) {
+	if order.queue == nil {
+		return
+	}
+	p.orderbooks.GetOrderbook(order.Symbol).LeaveQueue(order.queue)
+	order.queue = nil
+}
+
+// / fill whatever has traded through the front of the queue at our price
+func (p *TradeIntercept) fillFromQueue(order *Order) {
+	if order.queue == nil || !order.IsOpen() {
+		return
+	}
+	qty := p.orderbooks.GetOrderbook(order.Symbol).QueueFill(order.queue, order.LeavesQty())
+	if qty > 0 {
+		p.log("queue fill for ", order.OrderUserref, " ", qty, " @ ", order.LimitPrice)
+		p.fill(order, qty, order.LimitPrice)
+	}
+}
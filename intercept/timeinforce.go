@@ -0,0 +1,113 @@
+package intercept
+
+import (
+	"time"
+)
+
+const (
+	GTC = "gtc"
+	GTD = "gtd"
+	IOC = "ioc"
+	FOK = "fok"
+
+	EXPIRE_TIME_ERROR = "EGeneral:Invalid arguments:expire_time"
+)
+
+// / checkTimeInForce returns Kraken's error for an expire_time that isn't a time, or a gtd order without one
+func (p *TradeIntercept) checkTimeInForce(order *Order) string {
+	if order.badexpiry || (order.TimeInForce == GTD && order.ExpireTime.IsZero()) {
+		return EXPIRE_TIME_ERROR
+	}
+	return ""
+}
+
+// / startMatching is called once an order is live - accepted, or triggered if it has a trigger
+func (p *TradeIntercept) startMatching(order *Order) {
+	if order.AwaitingTrigger() {
+		return
+	}
+	/// whether it takes liquidity is decided by the book as it goes live
+	order.Taker = order.IsMarket() || p.bookDepth(order) > 0
+	if p.immediateOrCancel(order) {
+		return
+	}
+	if p.fillmode == FILL_IMMEDIATE {
+		p.fillImmediate(order)
+	}
+}
+
+// / immediateOrCancel handles ioc and fok orders, which trade once with what the book has now and never rest.
+// /   Kraken never rests a market order either, so they are ioc whatever they asked for, unless they are fok.
+// /   In the immediate fill mode limit orders fill in full as usual. Returns false for orders that do rest.
+func (p *TradeIntercept) immediateOrCancel(order *Order) bool {
+	var reason string
+	timeinforce := order.TimeInForce
+	if order.IsMarket() && timeinforce != FOK {
+		timeinforce = IOC
+	}
+	switch timeinforce {
+	case IOC:
+		reason = "Immediate or cancel"
+		if order.TimeInForce != IOC {
+			reason = "Insufficient liquidity"
+		}
+		if p.fillmode == FILL_IMMEDIATE && !order.IsMarket() {
+			p.fillImmediate(order)
+		} else {
+			p.walkBook(order)
+		}
+	case FOK:
+		reason = "Fill or kill"
+		if p.fillmode == FILL_IMMEDIATE && !order.IsMarket() {
+			p.fillImmediate(order)
+		} else if p.bookDepth(order) >= order.LeavesQty() {
+			p.walkBook(order)
+		}
+	default:
+		return false
+	}
+	if order.IsOpen() {
+		p.traderesp <- []*Execution{p.closeOrder(order, CANCELED, reason)}
+	}
+	return true
+}
+
+// / bookDepth is how much of the order the book could fill now
+func (p *TradeIntercept) bookDepth(order *Order) float64 {
+	orderbook := p.orderbooks.GetOrderbook(order.Symbol)
+	if order.Side == "buy" {
+		return orderbook.DepthAsks(order.WalkPrice())
+	}
+	return orderbook.DepthBids(order.WalkPrice())
+}
+
+// / startExpiry sets the timer for a gtd order, it tells the southbound thread when the order expires
+func (p *TradeIntercept) startExpiry(order *Order) {
+	if order.TimeInForce != GTD || order.ExpireTime.IsZero() {
+		return
+	}
+	order.expiry = p.afterfunc(time.Until(order.ExpireTime), func() {
+		select {
+		case p.expiries <- order:
+		case <-p.done:
+		}
+	})
+}
+
+func (p *TradeIntercept) stopExpiry(order *Order) {
+	if order.expiry != nil {
+		order.expiry.Stop()
+		order.expiry = nil
+	}
+}
+
+// / checkExpiries expires the gtd orders whose timers have gone off, unless they finished first
+func (p *TradeIntercept) checkExpiries() {
+	for len(p.expiries) > 0 {
+		order := <-p.expiries
+		if !order.IsOpen() {
+			continue
+		}
+		p.traderesp <- []*Execution{p.closeOrder(order, EXPIRED, "Order expired")}
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"github.com/paul-at-nangalan/errorhandler/handlers"
 	"github.com/paul-at-nangalan/json-config/cfg"
+	"kraken-test-proxy-v2/accounts"
+	instruments2 "kraken-test-proxy-v2/instruments"
 	orderbooks2 "kraken-test-proxy-v2/orderbooks"
 	"kraken-test-proxy-v2/recorder"
-	"strings"
+	"os"
 	"time"
 )
 
@@ -15,81 +17,167 @@ const (
 	TIMEFORMAT = "2006-01-02T15:04:05.000000Z"
 )
 
-type Filter struct {
-	Matchon   string
-	FilterOut bool
-}
+// / How simulated orders get filled
+const (
+	FILL_IMMEDIATE = "immediate" /// in full, as soon as the order is accepted
+	FILL_ORDERBOOK = "orderbook" /// when the public order book crosses them, or trades through the queue in front of them
+	FILL_TRADES    = "trades"    /// when a public trade prints at or through their price
+)
 
 type TradeInterceptCfg struct {
 	Enabled        bool
-	FeeRatio       float64
-	LogFilters     []Filter
-	MatchOrderBook bool ///  if true, only send a trade response if the price would match an order in the order book
+	FeeRatio       float64     /// the maker and taker fee if they aren't set
+	MakerFee       float64     /// ratio, e.g. 0.0025
+	TakerFee       float64     /// ratio, e.g. 0.004
+	FeeTiers       []FeeTier   /// replaces MakerFee and TakerFee as the account's 30 day volume reaches each tier
+	FillMode       string      /// immediate, orderbook or trades, see the FILL_ constants. Defaults from MatchOrderBook
+	MatchOrderBook bool        ///  if true, only send a trade response if the price would match an order in the order book
+	IdSeed         int64       /// makes the order, exec and trade ids the same every run, 0 for different ones
+	MaxOpenOrders  int         /// open orders allowed per account and pair before "EOrder:Orders limit exceeded", 0 for no limit
+	ErrorRules     []ErrorRule /// errors, delays and timeouts to inject, the first rule to hit a request applies
+	AssetPairs     string      /// moved to Instruments.AssetPairs in server.json, still used from here if that isn't set
+	LogFilters     []Filter    /// moved to log-filter.json, still used from here if that has none
 }
 
 func (p *TradeInterceptCfg) Expand() {
+	p.AssetPairs = os.ExpandEnv(p.AssetPairs)
+	for i := range p.ErrorRules {
+		p.ErrorRules[i].Expand()
+	}
+	if p.MakerFee == 0 && p.TakerFee == 0 {
+		p.MakerFee = p.FeeRatio
+		p.TakerFee = p.FeeRatio
+	}
+	if p.FillMode == "" {
+		p.FillMode = FILL_IMMEDIATE
+		if p.MatchOrderBook {
+			p.FillMode = FILL_ORDERBOOK
+		}
+	}
+}
+
+// / timer is the part of a time.Timer the intercept needs
+type timer interface {
+	Stop() bool
+}
+
+// / realAfterFunc is time.AfterFunc, the intercept's timers go through afterfunc so tests can fire them themselves
+func realAfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
 }
 
 type TradeIntercept struct {
 	enabled  bool
-	feeratio float64
+	makerfee float64
+	takerfee float64
+	feetiers []FeeTier /// lowest volume first
 
-	///Only the southbound thread should touch this map
-	pendingtrades map[int64]*Execution
-	pastrtrades   map[int64]*Execution
+	///Only the southbound thread should touch these
+	pendingtrades *orderStore /// open orders, and ones waiting for their add_order response
+	pastrtrades   *orderStore /// done with - filled, canceled or expired
 
 	orderrequests chan *OrderReq
 	cancelorders  chan *CancelRequest
+	batchrequests chan *BatchAddReq
+	batchcancels  chan *BatchCancelReq
+	amendrequests chan *AmendReq
 	/// Once we see an order response - enqueue an exec response for the next round
-	traderesp  chan []*Execution
-	cancelresp chan *CancelResp
-	execid     int64
-	sequence   int64
+	traderesp    chan []*Execution
+	snapshotresp chan []*Execution /// past executions for a new subscriber
+	cancelresp   chan *CancelResp
+	responses    chan interface{} /// any other response to inject, marshalled as is
+
+	/// the orders in each batch_add waiting for its response, oldest first - southbound thread only
+	pendingbatches []*pendingBatch
+	/// amend_order and edit_order requests waiting for their response, oldest first - southbound thread only
+	pendingamends []*AmendReq
+	///batch cancels waiting for their responses, oldest first
+	pendingbatchcancels []*BatchCancelReq
+
+	afterfunc     func(d time.Duration, f func()) timer /// starts the dead man's switch, expiry and delay timers
+	deadmanswitch timer                                 /// cancel_all_orders_after - northbound thread only
+	deadmanfired  chan struct{}                         /// tells the southbound thread to cancel everything
+	expiries      chan *Order                           /// gtd orders whose time is up, from their timers
+	done          chan struct{}                         /// closed with the connection, so the timers don't wait to send to it
+
+	balancesubs       chan bool /// balances channel subscribes (true) and unsubscribes
+	balancesubscribed bool      /// southbound thread only
+	balancesequence   int64
+	margintraded      bool /// the connection has margin positions to look after - southbound thread only
+	liquidationid     int64
+	sequence          int64
 
 	enablelogging bool
 
 	msgreplay *recorder.MessageReplay
 
-	logfilterin  []string
-	logfilterout []string
+	fillmode string
 
-	matchorderbook bool
+	maxopenorders int
 
-	orderbooks *orderbooks2.SharedOrderbook
+	ids IdGenerator /// southbound thread only, unless it is safe to share
+
+	errorrules []*ErrorRule         /// the rules' hit counts are northbound thread only
+	rulehits   chan *ruleHit        /// requests hit by drop and delay rules
+	heldreqs   map[ruleKey]*ruleHit /// southbound thread only
+
+	orderbooks  *orderbooks2.SharedOrderbook
+	account     *accounts.Account      /// the simulated account the connection trades on
+	instruments *instruments2.Registry /// the pairs orders are checked against and rounded to
 }
 
-func NewTradeIntercept(enablelogging bool, msgreplay *recorder.MessageReplay, orderbook *orderbooks2.SharedOrderbook) *TradeIntercept {
+func NewTradeIntercept(enablelogging bool, msgreplay *recorder.MessageReplay, orderbook *orderbooks2.SharedOrderbook,
+	account *accounts.Account, instruments *instruments2.Registry) *TradeIntercept {
 	tradeinterceptcfg := TradeInterceptCfg{}
 	err := cfg.Read("trade-intercept", &tradeinterceptcfg)
 	handlers.PanicOnError(err)
-
-	southboundfilterin := make([]string, 0)
-	southboundfilterout := make([]string, 0)
-	for _, filter := range tradeinterceptcfg.LogFilters {
-		if filter.FilterOut {
-			southboundfilterout = append(southboundfilterout, filter.Matchon)
-		} else {
-			southboundfilterin = append(southboundfilterin, filter.Matchon)
-		}
+	switch tradeinterceptcfg.FillMode {
+	case FILL_IMMEDIATE, FILL_ORDERBOOK, FILL_TRADES:
+	default:
+		handlers.PanicOnError(fmt.Errorf("unknown FillMode %s in trade-intercept", tradeinterceptcfg.FillMode))
+	}
+	errorrules := make([]*ErrorRule, 0, len(tradeinterceptcfg.ErrorRules))
+	for i := range tradeinterceptcfg.ErrorRules {
+		handlers.PanicOnError(tradeinterceptcfg.ErrorRules[i].check())
+		errorrules = append(errorrules, &tradeinterceptcfg.ErrorRules[i])
 	}
 
 	tradeintercept := &TradeIntercept{
 		enabled:       tradeinterceptcfg.Enabled,
-		feeratio:      tradeinterceptcfg.FeeRatio,
-		pendingtrades: make(map[int64]*Execution),
+		makerfee:      tradeinterceptcfg.MakerFee,
+		takerfee:      tradeinterceptcfg.TakerFee,
+		feetiers:      sortedTiers(tradeinterceptcfg.FeeTiers),
+		pendingtrades: newOrderStore(0),
 		orderrequests: make(chan *OrderReq, 100),
 		traderesp:     make(chan []*Execution, 100),
 		cancelorders:  make(chan *CancelRequest, 100),
 		cancelresp:    make(chan *CancelResp, 100),
-		pastrtrades:   make(map[int64]*Execution),
+		pastrtrades:   newOrderStore(MAXPASTORDERS),
+		snapshotresp:  make(chan []*Execution, 100),
+		batchrequests: make(chan *BatchAddReq, 100),
+		batchcancels:  make(chan *BatchCancelReq, 100),
+		responses:     make(chan interface{}, 100),
+
+		amendrequests: make(chan *AmendReq, 100),
+
+		afterfunc:    realAfterFunc,
+		deadmanfired: make(chan struct{}, 1),
+		expiries:     make(chan *Order, 100),
+		done:         make(chan struct{}),
+		balancesubs:  make(chan bool, 10),
 
 		enablelogging: enablelogging,
 		msgreplay:     msgreplay,
-		logfilterin:   southboundfilterin,
-		logfilterout:  southboundfilterout,
 
-		matchorderbook: tradeinterceptcfg.MatchOrderBook,
-		orderbooks:     orderbook,
+		fillmode:      tradeinterceptcfg.FillMode,
+		maxopenorders: tradeinterceptcfg.MaxOpenOrders,
+		ids:           NewKrakenIds(tradeinterceptcfg.IdSeed),
+		errorrules:    errorrules,
+		rulehits:      make(chan *ruleHit, 100),
+		heldreqs:      make(map[ruleKey]*ruleHit),
+		orderbooks:    orderbook,
+		account:       account,
+		instruments:   instruments,
 	}
 
 	return tradeintercept
@@ -101,7 +189,7 @@ func (p *TradeIntercept) log(msgs ...interface{}) {
 	}
 }
 
-func (p *TradeIntercept) Northbound(msg []byte) (forward bool) {
+func (p *TradeIntercept) Northbound(msg []byte) (out []byte, forward bool) {
 	if p.enabled {
 		///peak at the msg
 		datamap := make(map[string]interface{})
@@ -109,44 +197,42 @@ func (p *TradeIntercept) Northbound(msg []byte) (forward bool) {
 		handlers.PanicOnError(err)
 		method, ok := datamap["method"].(string)
 		if ok {
+			noexec := false
+			if rule := p.applyRules(msg); rule != nil {
+				switch rule.Action {
+				case RULE_ERROR:
+					///the error has been injected in its place
+					return msg, false
+				case RULE_NOEXEC:
+					noexec = true
+				}
+			}
 			switch method {
 			case "add_order":
-				params := datamap["params"].(map[string]interface{})
-				orderparams := OrderParams{
-					LimitPrice:   params["limit_price"].(float64),
-					OrderType:    params["order_type"].(string),
-					OrderUserref: int64(params["order_userref"].(float64)),
-					OrderQty:     params["order_qty"].(float64),
-					Side:         params["side"].(string),
-					Symbol:       params["symbol"].(string),
-					Validate:     params["validate"].(bool),
-					Margin:       params["margin"].(bool),
-				}
-
-				req := &OrderReq{
-					Method: method,
-					Params: orderparams,
-					ReqId:  int64(datamap["req_id"].(float64)),
-				}
+				/// market orders have no limit_price, and most of the rest is optional
+				req := &OrderReq{}
+				err := json.Unmarshal(msg, req)
+				handlers.PanicOnError(err)
 				//fmt.Println("adding order request to queue")
-				p.orderrequests <- req
+				if !noexec {
+					p.orderrequests <- req
+				}
 
 			case "cancel_order":
-				//// inject a cancel_order +ve response
-				params := datamap["params"].(map[string]interface{})
-				orders := params["order_userref"].([]interface{})
-				cancelparams := CancelParams{
-					Orderuserref: make([]int64, 0),
-				}
-				for _, order := range orders {
-					cancelparams.Orderuserref = append(cancelparams.Orderuserref, int64(order.(float64)))
-				}
-				cancelorder := CancelRequest{
-					Method: "cancel_order",
-					Params: cancelparams,
-					ReqId:  int64(datamap["req_id"].(float64)),
-				}
+				//// inject a cancel_order +ve response - the orders are by order_id, cl_ord_id and/or order_userref
+				cancelorder := CancelRequest{}
+				err := json.Unmarshal(msg, &cancelorder)
+				handlers.PanicOnError(err)
+				cancelorder.noexec = noexec
 				p.cancelorders <- &cancelorder
+			case "batch_add":
+				p.northboundBatchAdd(msg)
+			case "batch_cancel":
+				p.northboundBatchCancel(msg)
+			case "amend_order", "edit_order":
+				p.northboundAmend(msg)
+			case "cancel_all_orders_after":
+				p.northboundCancelAfter(msg)
 			case "subscribe":
 				///see if this is a subscribe to the executions channel
 				params := datamap["params"].(map[string]interface{})
@@ -157,122 +243,180 @@ func (p *TradeIntercept) Northbound(msg []byte) (forward bool) {
 						for _, exec := range execs {
 							marshalled = append(marshalled, exec.(*Execution))
 						}
-						p.traderesp <- marshalled
+						p.snapshotresp <- marshalled
 					}
 
 				}
+				if params["channel"].(string) == "balances" {
+					p.northboundBalances(true)
+				}
+			case "unsubscribe":
+				params, _ := datamap["params"].(map[string]interface{})
+				if params["channel"] == "balances" {
+					p.northboundBalances(false)
+				}
 			}
 		}
 	}
-	return true
+	return msg, true
 }
 
 func (p *TradeIntercept) handleOrderReq() {
 	for len(p.orderrequests) > 0 {
 		orderreq := <-p.orderrequests
 		fmt.Println("pull order req from the queue")
-		execid := fmt.Sprint("XXX", p.execid)
-		p.execid++
-		orderid := fmt.Sprint("XXX", orderreq.ReqId)
-
-		///The cost ought to be in the currency being sold
-		cost := float64(0)
-		if orderreq.Params.Side == "buy" {
-			///if we are buying, then the cost is the qty of the 1st currency
-			cost = (orderreq.Params.OrderQty) +
-				(orderreq.Params.OrderQty * p.feeratio)
-		} else {
-			///if we are selling, the cost is the qty of the 2nd currency
-			cost = (orderreq.Params.OrderQty * orderreq.Params.LimitPrice) +
-				(orderreq.Params.OrderQty * orderreq.Params.LimitPrice * p.feeratio)
-		}
+		p.addPendingOrder(orderreq, p.ids.OrderId())
+	}
+	p.handleBatchReq()
+	p.handleBatchCancelReq()
+	p.handleAmendReq()
+}
 
-		fees := Fee{
-			Asset: strings.Split(orderreq.Params.Symbol, "/")[1],
-			/// qty of 1st * price of 2nd = qty of 2nd. qty of 2nd * fees ratio = total fees
-			Qty: orderreq.Params.OrderQty * orderreq.Params.LimitPrice * p.feeratio,
+// / Put the order in the pending trades, it is accepted when the add_order response comes back
+func (p *TradeIntercept) addPendingOrder(orderreq *OrderReq, orderid string) *Order {
+	order := NewOrder(orderreq, orderid)
+	p.log("add pending order ", order.OrderId, " ", order.ClOrdId, " ", order.OrderUserref)
+	p.pendingtrades.add(order)
+	return order
+}
+
+// / awaitingAdd is true for an order waiting for its add_order (not batch_add) response
+func awaitingAdd(order *Order) bool {
+	return order != nil && order.Status == PENDING_NEW && !order.batch
+}
+
+// / findPendingAdd finds the order an add_order response is for - by the cl_ord_id or order_userref in the
+// /   result if there is one (preferring the same req_id), otherwise by req_id, which is optional
+func (p *TradeIntercept) findPendingAdd(datamap map[string]interface{}) *Order {
+	reqid, _ := datamap["req_id"].(float64)
+	result, _ := datamap["result"].(map[string]interface{})
+	if clordid, _ := result["cl_ord_id"].(string); clordid != "" {
+		if order := p.pendingtrades.getByClOrdId(clordid); awaitingAdd(order) {
+			return order
 		}
-		exec := Execution{
-			//// This is not clearly defined on Kraken docs ... but I think it should be how much we had to sell (whether its a buy or sell order)
-			///   of an asset to get the other asset
-			Cost:         cost,
-			ExecId:       execid,
-			ExecType:     "trade",
-			Fees:         []Fee{fees},
-			LiquidityInd: "m",
-			OrdType:      "limit",
-			OrderId:      orderid,
-			LastQty:      orderreq.Params.OrderQty,
-			OrderUserref: orderreq.Params.OrderUserref,
-			LastPrice:    orderreq.Params.LimitPrice,
-			Side:         orderreq.Params.Side,
-			Symbol:       orderreq.Params.Symbol,
-			Timestamp:    time.Now().Format(TIMEFORMAT),
-			TradeId:      orderreq.Params.OrderUserref,
+	}
+	if userref, _ := result["order_userref"].(float64); userref != 0 {
+		var found *Order
+		for _, order := range p.pendingtrades.getByUserref(int64(userref)) {
+			if !awaitingAdd(order) {
+				continue
+			}
+			if order.ReqId == int64(reqid) {
+				return order
+			}
+			if found == nil {
+				found = order
+			}
+		}
+		if found != nil {
+			return found
 		}
-		p.log("move exec to the map by order user ref ", exec.OrderUserref, " ", exec.ExecId)
-		p.pendingtrades[orderreq.Params.OrderUserref] = &exec
 	}
-
+	for _, order := range p.pendingtrades.all() {
+		if order.ReqId == int64(reqid) && awaitingAdd(order) {
+			return order
+		}
+	}
+	return nil
 }
 
-func (p *TradeIntercept) CheckFilters(msg []byte) bool {
-	for _, filter := range p.logfilterin {
-		if strings.Contains(string(msg), filter) {
-			return true
+// / findPendingOrders finds the orders by any of their ids, oldest first. All the orders with a userref go.
+func (p *TradeIntercept) findPendingOrders(params *CancelParams) []*Order {
+	found := make(map[*Order]bool)
+	orders := make([]*Order, 0)
+	add := func(order *Order) {
+		if order != nil && !found[order] {
+			found[order] = true
+			orders = append(orders, order)
 		}
 	}
-	for _, filter := range p.logfilterout {
-		if strings.Contains(string(msg), filter) {
-			return false
+	for _, orderid := range params.OrderId {
+		add(p.pendingtrades.get(orderid))
+	}
+	for _, clordid := range params.ClOrdId {
+		add(p.pendingtrades.getByClOrdId(clordid))
+	}
+	for _, userref := range params.Orderuserref {
+		for _, order := range p.pendingtrades.getByUserref(userref) {
+			add(order)
 		}
-
 	}
-	return true
+	return orders
 }
 
 func (p *TradeIntercept) findAndQueueMatchedTrades() {
-	if p.matchorderbook {
-		///find and queue any matched trades
-		for _, exec := range p.pendingtrades {
-			//// See if the order would be filled based on latest orderbook data
-			orderbook := p.orderbooks.GetOrderbook(exec.Symbol)
-			isfilled := false
-			fillprice := 0.0
-			fillqty := 0.0
-			if exec.Side == "buy" {
-				fillprice, fillqty = orderbook.MatchBid(exec.LastPrice, exec.LastQty)
-				if fillqty > 0 {
-					isfilled = true
-				}
-			} else {
-				fillprice, fillqty = orderbook.MatchAsk(exec.LastPrice, exec.LastQty)
-				if fillqty > 0 {
-					isfilled = true
-				}
-			}
+	///find and queue any matched trades
+	for _, order := range p.pendingtrades.all() {
+		p.matchOrder(order)
+	}
+}
 
-			if isfilled {
-				exec.LastPrice = fillprice
-				exec.LastQty = fillqty
-				p.traderesp <- []*Execution{exec}
-				p.msgreplay.AddMessage(exec)
-				delete(p.pendingtrades, exec.OrderUserref)
-			}
+func (p *TradeIntercept) matchOrder(order *Order) {
+	if !order.IsOpen() {
+		///still waiting for the add_order response
+		return
+	}
+	if order.AwaitingTrigger() {
+		if !p.checkTrigger(order) {
+			return
+		}
+		p.startMatching(order)
+		if p.fillmode == FILL_IMMEDIATE || !order.IsOpen() {
+			return
 		}
 	}
+	switch p.fillmode {
+	case FILL_ORDERBOOK:
+		//// See if the order would be filled based on latest orderbook data - walking down the book
+		///   a level at a time, with a trade for each level at that level's price
+		p.walkBook(order)
+		///anything left is resting, so from now on it is the maker
+		order.Taker = false
+		p.fillFromQueue(order)
+	case FILL_TRADES:
+		p.matchPrints(order)
+	}
 }
 
-// // See if this order is in the pending trades map - if it is, clear it and put it on the past trades map
-func (p *TradeIntercept) cancelPendingTrades(cancelreq *CancelRequest) {
-	for _, order := range cancelreq.Params.Orderuserref {
-		exec, ok := p.pendingtrades[order]
-		if ok {
-			p.log("canceling trade ", exec.OrderUserref, " ", exec.ExecId)
-			p.pastrtrades[exec.OrderUserref] = exec
-			delete(p.pendingtrades, order)
-		}
+// // See if the orders are in the pending trades - if they are, cancel them and put them in the past trades
+func (p *TradeIntercept) cancelPendingTrades(cancelreq *CancelRequest) []*Order {
+	if cancelreq.noexec {
+		return nil
+	}
+	orders := p.findPendingOrders(&cancelreq.Params)
+	reports := make([]*Execution, 0, len(orders))
+	for _, order := range orders {
+		reports = append(reports, p.closeOrder(order, CANCELED, "User requested"))
+	}
+	if len(reports) > 0 {
+		p.traderesp <- reports
 	}
+	return orders
+}
+
+// / cancelResults has a result for each order canceled, or if there weren't any, for each id asked for
+func (p *TradeIntercept) cancelResults(cancelreq *CancelRequest, canceled []*Order) []CancelResult {
+	results := make([]CancelResult, 0)
+	for _, order := range canceled {
+		results = append(results, CancelResult{
+			OrderId:      order.OrderId,
+			ClOrdId:      order.ClOrdId,
+			Orderuserref: order.OrderUserref,
+		})
+	}
+	if len(results) > 0 {
+		return results
+	}
+	for _, orderid := range cancelreq.Params.OrderId {
+		results = append(results, CancelResult{OrderId: orderid})
+	}
+	for _, clordid := range cancelreq.Params.ClOrdId {
+		results = append(results, CancelResult{ClOrdId: clordid})
+	}
+	for _, userref := range cancelreq.Params.Orderuserref {
+		results = append(results, CancelResult{Orderuserref: userref})
+	}
+	return results
 }
 
 func (p *TradeIntercept) processCancelOrder(datamap map[string]interface{}, msg []byte) bool {
@@ -283,15 +427,14 @@ func (p *TradeIntercept) processCancelOrder(datamap map[string]interface{}, msg
 			//replace this message with a success message for all cancellations
 			p.log("Replacing ", string(msg), " with successful cancel")
 			orders := <-p.cancelorders
-			p.cancelPendingTrades(orders)
-			for _, order := range orders.Params.Orderuserref {
-
+			canceled := p.cancelPendingTrades(orders)
+			results := p.cancelResults(orders, canceled)
+			p.expectResponses("cancel_order", int64(datamap["req_id"].(float64)), len(results))
+			for _, result := range results {
 				cancelresp := &CancelResp{
-					Method: "cancel_order",
-					ReqId:  int64(datamap["req_id"].(float64)),
-					Result: CancelResult{
-						Orderuserref: order,
-					},
+					Method:  "cancel_order",
+					ReqId:   int64(datamap["req_id"].(float64)),
+					Result:  result,
 					Success: true,
 					TimeIn:  time.Now().Format(TIMEFORMAT),
 					TimeOut: time.Now().Format(TIMEFORMAT),
@@ -311,64 +454,71 @@ func (p *TradeIntercept) processCancelOrder(datamap map[string]interface{}, msg
 	return true
 }
 
-func (p *TradeIntercept) processAddOrder(datamap map[string]interface{}, msg []byte) bool {
-	result := datamap["result"].(map[string]interface{})
-	orderresult := OrderResult{
-		OrderId:      "",
-		OrderUserref: int64(result["order_userref"].(float64)),
+func (p *TradeIntercept) processAddOrder(datamap map[string]interface{}, msg []byte) []byte {
+	reqid, _ := datamap["req_id"].(float64)
+	order := p.findPendingAdd(datamap)
+	if order == nil {
+		return msg
 	}
-	orderressp := OrderResp{
-		Method:  "",
-		ReqId:   int64(datamap["req_id"].(float64)),
-		Result:  orderresult,
-		Success: datamap["success"].(bool),
-		TimeIn:  time.Time{}, ///don't care
-		TimeOut: time.Time{},
+
+	success, _ := datamap["success"].(bool)
+	if !success {
+		///rejected, so it never existed
+		p.pendingtrades.remove(order)
+		return msg
+	}
+	if reason := p.checkOrder(order); reason != "" {
+		///the upstream doesn't know it would have been rejected, so it never existed either
+		p.log("Replacing ", string(msg), " with ", reason)
+		p.pendingtrades.remove(order)
+		return p.rejection("add_order", int64(reqid), reason)
 	}
+	p.acceptOrder(order)
 	/// Full test mode - simply send a trade in response as soon as we see the order response
 	/// Otherwise we must look for an orderbook match
-	if !p.matchorderbook {
-		exectrade, ok := p.pendingtrades[orderressp.Result.OrderUserref]
-		if ok {
-			fmt.Println("push exec to queue")
-			p.traderesp <- []*Execution{exectrade}
-			p.msgreplay.AddMessage(exectrade)
-			delete(p.pendingtrades, orderressp.Result.OrderUserref)
+	p.startMatching(order)
+	return p.withOrderIds(datamap, []*Order{order})
+}
+
+func (p *TradeIntercept) processBook(datamap map[string]interface{}) {
+	/// The datamap should have a key "data" containing a list of books, each with the symbol
+	///   and "asks" and "bids", each of which is an array of maps with keys "price" and "qty"
+	books, _ := datamap["data"].([]interface{})
+	for _, book := range books {
+		bookmap := book.(map[string]interface{})
+		///use the symbol to get the orderbook from the shared orderbook
+		orderbook := p.orderbooks.GetOrderbook(bookmap["symbol"].(string))
+		if datamap["type"] == "snapshot" {
+			orderbook.Clear()
 		}
+		orderbook.AddBids(p.bookLevels(bookmap["bids"]))
+		/// now do the same for asks
+		orderbook.AddAsks(p.bookLevels(bookmap["asks"]))
 	}
-	return true
 }
 
-func (p *TradeIntercept) processBook(datamap map[string]interface{}) {
-	///firstly get the symbol from the datamap, and use that to get the orderbook from the shared orderbook
-	symbol := datamap["symbol"].(string)
-	orderbook := p.orderbooks.GetOrderbook(symbol)
-	/// The datamap should have a key "data" containing a map of "asks" and "bids"
-	///   each of which is an array of maps with keys "price" and "qty"
-	bids := datamap["data"].(map[string]interface{})["bids"].([]interface{})
-	asks := datamap["data"].(map[string]interface{})["asks"].([]interface{})
-	marshalledbids := make([]*orderbooks2.BidAsk, len(bids))
-	for _, bid := range bids {
-		bidmap := bid.(map[string]interface{})
-		marshalledbids = append(marshalledbids, orderbooks2.NewBidAsk(bidmap["price"].(float64), bidmap["qty"].(float64)))
-	}
-	orderbook.AddBids(marshalledbids)
-	/// now do the same for asks
-	marshalledasks := make([]*orderbooks2.BidAsk, len(asks))
-	for _, ask := range asks {
-		askmap := ask.(map[string]interface{})
-		marshalledasks = append(marshalledasks, orderbooks2.NewBidAsk(askmap["price"].(float64), askmap["qty"].(float64)))
-	}
-	orderbook.AddAsks(marshalledasks)
+func (p *TradeIntercept) bookLevels(levels interface{}) []*orderbooks2.BidAsk {
+	levellist, _ := levels.([]interface{})
+	marshalled := make([]*orderbooks2.BidAsk, 0, len(levellist))
+	for _, level := range levellist {
+		levelmap := level.(map[string]interface{})
+		marshalled = append(marshalled, orderbooks2.NewBidAsk(levelmap["price"].(float64), levelmap["qty"].(float64)))
+	}
+	return marshalled
 }
 
-func (p *TradeIntercept) Southbound(msg []byte) (forward bool) {
+func (p *TradeIntercept) Southbound(msg []byte) (out []byte, forward bool) {
 	if p.enabled {
 		//// dequeu any previous northbound order requests and put into a map - this is to avoid 2 threads accessing the map
 		///   this puts a execution type onto the map - all we need to do then is wait for the corresponding
 		///   south bound add_order success message and inject the execution _after_ by putting it on the traderesp queue
 		p.handleOrderReq()
+		p.checkDeadManSwitch()
+		p.checkExpiries()
+		p.handleBalanceSubs()
 		p.findAndQueueMatchedTrades()
+		p.checkPositions()
+		p.handleRuleHits()
 
 		///now look at the southbound message to see if it is an order resposne for any order requests
 		datamap := make(map[string]interface{})
@@ -376,35 +526,88 @@ func (p *TradeIntercept) Southbound(msg []byte) (forward bool) {
 		handlers.PanicOnError(err)
 		method, ok := datamap["method"].(string)
 		if ok && method == "add_order" {
-			if !p.processAddOrder(datamap, msg) {
-				return false
-			}
+			msg = p.processAddOrder(datamap, msg)
 		}
 		if ok && method == "cancel_order" {
 			if !p.processCancelOrder(datamap, msg) {
-				return false
+				return msg, false
+			}
+		}
+		if ok && method == "batch_add" {
+			msg = p.processBatchAdd(datamap, msg)
+		}
+		if ok && (method == "amend_order" || method == "edit_order") {
+			if !p.processAmend(datamap, msg) {
+				return msg, false
 			}
 		}
+		if ok && method == "cancel_all" {
+			msg = p.processCancelAll(datamap, msg)
+		}
+		if ok && method == "batch_cancel" {
+			if !p.processBatchCancel(datamap, msg) {
+				return msg, false
+			}
+		}
+		/// market data is needed whatever the fill mode, for market orders and triggers
 		channel, ok := datamap["channel"].(string)
 		if ok && channel == "book" {
-			if p.matchorderbook {
-				p.processBook(datamap)
+			p.processBook(datamap)
+		}
+		if ok && channel == "trade" {
+			p.processTrades(datamap)
+		}
+		if ok && channel == "ticker" {
+			p.processTicker(datamap)
+		}
+		if ok && channel == "instrument" {
+			err = p.instruments.Refresh(msg)
+			handlers.PanicOnError(err)
+		}
+		if ok && channel == "balances" && datamap["type"] != nil {
+			///the data, not the subscribe response
+			msg, forward = p.processBalances(datamap, msg)
+			if !forward {
+				return msg, false
 			}
 		}
+		return p.holdResponse(msg)
+	}
+	return msg, true
+}
+
+// / Close is called once the connection has gone, from the southbound thread. It stops the gtd expiry timers, and
+// /   the timers still running give up rather than wait to send to a connection that no one is reading.
+func (p *TradeIntercept) Close() {
+	select {
+	case <-p.done:
+		return
+	default:
+		close(p.done)
+	}
+	for _, order := range p.pendingtrades.all() {
+		p.stopExpiry(order)
 	}
-	return true
 }
 
 func (p *TradeIntercept) InjectSouth() (msg []byte) {
 	if p.enabled {
 
-		if len(p.traderesp) > 0 {
-			exec := <-p.traderesp
+		if len(p.snapshotresp) > 0 || len(p.traderesp) > 0 {
+			msgtype := "update"
+			var exec []*Execution
+			if len(p.snapshotresp) > 0 {
+				msgtype = "snapshot"
+				exec = <-p.snapshotresp
+			} else {
+				exec = <-p.traderesp
+			}
+			p.sequence++
 			execmsg := &ExecMsg{
 				Channel:  "executions",
 				Data:     exec,
 				Sequence: p.sequence,
-				Type:     "snapshot",
+				Type:     msgtype,
 			}
 			msg, err := json.Marshal(execmsg)
 			handlers.PanicOnError(err)
@@ -415,6 +618,19 @@ func (p *TradeIntercept) InjectSouth() (msg []byte) {
 			msg, err := json.Marshal(cancelresp)
 			handlers.PanicOnError(err)
 			//p.log("sending cancel response ", string(msg))
+			if _, forward := p.holdResponse(msg); !forward {
+				return p.InjectSouth()
+			}
+			return msg
+		} else if len(p.responses) > 0 {
+			resp := <-p.responses
+			msg, err := json.Marshal(resp)
+			handlers.PanicOnError(err)
+			if _, delayed := resp.(delayedResp); !delayed {
+				if _, forward := p.holdResponse(msg); !forward {
+					return p.InjectSouth()
+				}
+			}
 			return msg
 		}
 	}
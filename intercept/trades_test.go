@@ -0,0 +1,1353 @@
+package intercept
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"kraken-test-proxy-v2/accounts"
+	"kraken-test-proxy-v2/instruments"
+	orderbooks2 "kraken-test-proxy-v2/orderbooks"
+	"kraken-test-proxy-v2/recorder"
+)
+
+// / pendingOrder is the oldest pending order with the userref, or nil
+func pendingOrder(tradeintercept *TradeIntercept, userref int64) *Order {
+	orders := tradeintercept.pendingtrades.getByUserref(userref)
+	if len(orders) == 0 {
+		return nil
+	}
+	return orders[0]
+}
+
+func newTestIntercept(t *testing.T, tradeinterceptcfg string) *TradeIntercept {
+	setupCfg(t, map[string]string{"trade-intercept": tradeinterceptcfg})
+	registry, err := instruments.NewRegistry(instruments.InstrumentsCfg{})
+	assert.Nil(t, err)
+	return NewTradeIntercept(false, recorder.NewMessageReplay(), orderbooks2.NewSharedOrderbook([]string{"BTC/USD"}),
+		accounts.NewAccount(accounts.DEFAULT, accounts.BalancesCfg{}, accounts.MarginCfg{}), registry)
+}
+
+// / drain pops everything injected, returning the execution reports and the other responses separately
+func drain(t *testing.T, tradeintercept *TradeIntercept) (reports []map[string]interface{}, responses []map[string]interface{}) {
+	for msg := tradeintercept.InjectSouth(); msg != nil; msg = tradeintercept.InjectSouth() {
+		datamap := make(map[string]interface{})
+		assert.Nil(t, json.Unmarshal(msg, &datamap))
+		if datamap["channel"] != "executions" {
+			responses = append(responses, datamap)
+			continue
+		}
+		for _, report := range datamap["data"].([]interface{}) {
+			reports = append(reports, report.(map[string]interface{}))
+		}
+	}
+	return reports, responses
+}
+
+func execTypes(reports []map[string]interface{}) []string {
+	exectypes := make([]string, 0, len(reports))
+	for _, report := range reports {
+		exectypes = append(exectypes, report["exec_type"].(string))
+	}
+	return exectypes
+}
+
+// / place an order, and accept it
+func addOrder(t *testing.T, tradeintercept *TradeIntercept, reqid int, userref int, side string, price float64, qty float64) {
+	req := fmt.Sprintf(`{"method":"add_order","req_id":%d,"params":{"order_type":"limit","side":"%s","limit_price":%f,
+		"order_qty":%f,"order_userref":%d,"symbol":"BTC/USD","validate":true,"margin":false}}`, reqid, side, price, qty, userref)
+	_, forward := tradeintercept.Northbound([]byte(req))
+	assert.True(t, forward)
+	_, forward = tradeintercept.Southbound([]byte(fmt.Sprintf(`{"method":"add_order","req_id":%d,"success":true,"result":{"order_userref":%d}}`, reqid, userref)))
+	assert.True(t, forward)
+}
+
+func addRestingOrder(t *testing.T, tradeintercept *TradeIntercept, reqid int, userref int) {
+	addOrder(t, tradeintercept, reqid, userref, "buy", 100, 1)
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026}`)
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":1,"params":{"order_type":"limit","side":"buy",
+		"limit_price":100,"order_qty":2,"order_userref":5,"symbol":"BTC/USD","validate":true,"margin":false}}`))
+	/// nothing until the response
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+
+	out, _ := tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":1,"success":true,"result":{"order_userref":5}}`))
+	resp := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(out, &resp))
+	orderid := resp["result"].(map[string]interface{})["order_id"]
+	assert.Regexp(t, `^O[A-Z2-7]{5}-[A-Z2-7]{5}-[A-Z2-7]{6}$`, orderid)
+	assert.Equal(t, 5.0, resp["result"].(map[string]interface{})["order_userref"])
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "trade", "filled"}, execTypes(reports))
+	assert.Equal(t, "pending_new", reports[0]["order_status"])
+	assert.Equal(t, "new", reports[1]["order_status"])
+	assert.Equal(t, 0.0, reports[1]["cum_qty"])
+	assert.Equal(t, 2.0, reports[1]["leaves_qty"])
+	assert.Equal(t, "filled", reports[2]["order_status"])
+	assert.Equal(t, 2.0, reports[2]["last_qty"])
+	assert.Equal(t, 2.0, reports[2]["cum_qty"])
+	assert.Equal(t, 0.0, reports[2]["leaves_qty"])
+	assert.Equal(t, 100.0, reports[2]["avg_price"])
+	assert.Equal(t, 200.0, reports[2]["cum_cost"])
+	assert.Equal(t, "filled", reports[3]["order_status"])
+	for _, report := range reports {
+		assert.Equal(t, orderid, report["order_id"])
+		assert.Equal(t, "gtc", report["time_in_force"])
+	}
+
+	/// rejected orders never exist
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":2,"params":{"order_type":"limit","side":"buy",
+		"limit_price":100,"order_qty":2,"order_userref":6,"symbol":"BTC/USD","validate":true,"margin":false}}`))
+	tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":2,"success":false,"error":"EGeneral:Invalid arguments"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+
+	/// a new subscriber gets the past trades as a snapshot
+	tradeintercept.Northbound([]byte(`{"method":"subscribe","params":{"channel":"executions"}}`))
+	time.Sleep(10 * time.Millisecond) ///the replay is filled asynchronously
+	tradeintercept.Northbound([]byte(`{"method":"subscribe","params":{"channel":"executions"}}`))
+	msg := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(tradeintercept.InjectSouth(), &msg))
+	assert.Equal(t, "snapshot", msg["type"])
+}
+
+func TestCancelOrder(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true}`)
+	addRestingOrder(t, tradeintercept, 1, 1)
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+
+	tradeintercept.Northbound([]byte(`{"method":"cancel_order","req_id":2,"params":{"order_userref":[1]}}`))
+	_, forward := tradeintercept.Southbound([]byte(`{"method":"cancel_order","req_id":2,"success":false,"error":"EOrder:Unknown order"}`))
+	assert.False(t, forward)
+	reports, responses := drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled"}, execTypes(reports))
+	assert.Equal(t, "canceled", reports[0]["order_status"])
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, true, responses[0]["success"])
+}
+
+func TestBatchAddAndCancel(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026}`)
+
+	_, forward := tradeintercept.Northbound([]byte(`{"method":"batch_add","req_id":10,"params":{"symbol":"BTC/USD",
+		"validate":true,"orders":[
+			{"order_type":"limit","side":"buy","limit_price":100,"order_qty":1,"order_userref":1},
+			{"order_type":"limit","side":"buy","limit_price":99,"order_qty":2,"order_userref":2}]}}`))
+	assert.True(t, forward)
+	out, forward := tradeintercept.Southbound([]byte(`{"method":"batch_add","req_id":10,"success":true,
+		"result":[{"order_userref":1},{"order_userref":2}]}`))
+	assert.True(t, forward)
+	resp := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(out, &resp))
+	results := resp["result"].([]interface{})
+	assert.Equal(t, 2, len(results))
+
+	reports, _ := drain(t, tradeintercept)
+	trades := make([]map[string]interface{}, 0)
+	for _, report := range reports {
+		if report["exec_type"] == "trade" {
+			trades = append(trades, report)
+		}
+	}
+	assert.Equal(t, 2, len(trades))
+	assert.Equal(t, 1.0, trades[0]["order_userref"])
+	assert.Equal(t, 99.0, trades[1]["last_price"])
+	assert.Equal(t, "BTC/USD", trades[1]["symbol"])
+	assert.NotEqual(t, trades[0]["order_id"], trades[1]["order_id"])
+	assert.Equal(t, results[1].(map[string]interface{})["order_id"], trades[1]["order_id"])
+	assert.NotEqual(t, trades[0]["trade_id"], trades[1]["trade_id"])
+
+	/// a rejected batch never fills
+	tradeintercept.Northbound([]byte(`{"method":"batch_add","req_id":11,"params":{"symbol":"BTC/USD",
+		"orders":[{"order_type":"limit","side":"sell","limit_price":100,"order_qty":1,"order_userref":3}]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"batch_add","req_id":11,"success":false,"error":"EGeneral:Invalid arguments"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+
+	/// Kraken can't find the orders, so the cancel is replaced with a success
+	_, forward = tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"batch_cancel","req_id":12,"params":{"orders":["1","%s"]}}`,
+		trades[1]["order_id"])))
+	assert.True(t, forward)
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"batch_cancel","req_id":12,"success":false,"error":"EOrder:Unknown order"}`))
+	assert.False(t, forward)
+	_, responses := drain(t, tradeintercept)
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, "batch_cancel", responses[0]["method"])
+	assert.Equal(t, true, responses[0]["success"])
+	///they had filled already, so there was nothing to cancel
+	assert.Equal(t, 0.0, responses[0]["orders_cancelled"])
+	assert.Equal(t, 12.0, responses[0]["req_id"])
+
+	///responses are matched to their batch cancels by req_id, whatever order they come back in
+	tradeintercept = newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "orderbook"}`)
+	addOrder(t, tradeintercept, 1, 7, "buy", 90, 1)
+	addOrder(t, tradeintercept, 2, 8, "buy", 90, 1)
+	drain(t, tradeintercept)
+	tradeintercept.Northbound([]byte(`{"method":"batch_cancel","req_id":20,"params":{"orders":["7"]}}`))
+	tradeintercept.Northbound([]byte(`{"method":"batch_cancel","req_id":21,"params":{"orders":["8","9"]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"batch_cancel","req_id":21,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled"}, execTypes(reports))
+	assert.Equal(t, 8.0, reports[0]["order_userref"])
+	assert.Equal(t, 21.0, responses[0]["req_id"])
+	assert.Equal(t, 1.0, responses[0]["orders_cancelled"])
+	tradeintercept.Southbound([]byte(`{"method":"batch_cancel","req_id":20,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, 7.0, reports[0]["order_userref"])
+	assert.Equal(t, 20.0, responses[0]["req_id"])
+	assert.Equal(t, 1.0, responses[0]["orders_cancelled"])
+
+	///req_id is optional, batches without one are answered in the order they were sent
+	tradeintercept.Northbound([]byte(`{"method":"batch_add","params":{"symbol":"BTC/USD","orders":[
+		{"order_type":"limit","side":"buy","limit_price":90,"order_qty":1,"order_userref":30}]}}`))
+	tradeintercept.Northbound([]byte(`{"method":"batch_add","params":{"symbol":"BTC/USD","orders":[
+		{"order_type":"limit","side":"buy","limit_price":90,"order_qty":1,"order_userref":31}]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"batch_add","success":true,"result":[{"order_userref":30}]}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	assert.Equal(t, 30.0, reports[0]["order_userref"])
+	tradeintercept.Southbound([]byte(`{"method":"batch_add","success":true,"result":[{"order_userref":31}]}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 31.0, reports[0]["order_userref"])
+	tradeintercept.Northbound([]byte(`{"method":"batch_cancel","params":{"orders":["30"]}}`))
+	tradeintercept.Northbound([]byte(`{"method":"batch_cancel","params":{"orders":["31"]}}`))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"batch_cancel","success":false,"error":"EOrder:Unknown order"}`))
+	assert.False(t, forward)
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, 30.0, reports[0]["order_userref"])
+	assert.Nil(t, responses[0]["req_id"])
+	assert.Equal(t, 1.0, responses[0]["orders_cancelled"])
+	tradeintercept.Southbound([]byte(`{"method":"batch_cancel","success":false,"error":"EOrder:Unknown order"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 31.0, reports[0]["order_userref"])
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+}
+
+func TestAmendAndEdit(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true}`)
+	/// the book is empty, so the order rests
+	addOrder(t, tradeintercept, 1, 5, "buy", 100, 1)
+	drain(t, tradeintercept)
+	orderid := pendingOrder(tradeintercept, 5).OrderId
+
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"amend_order","req_id":2,"params":{"order_id":"%s","order_qty":2,
+		"limit_price":101}}`, orderid)))
+	_, forward := tradeintercept.Southbound([]byte(`{"method":"amend_order","req_id":2,"success":false,"error":"EOrder:Unknown order"}`))
+	assert.False(t, forward)
+	reports, responses := drain(t, tradeintercept)
+	assert.Equal(t, []string{"amended"}, execTypes(reports))
+	assert.Equal(t, orderid, reports[0]["order_id"])
+	assert.Equal(t, 2.0, reports[0]["order_qty"])
+	assert.Equal(t, 101.0, reports[0]["limit_price"])
+	assert.Equal(t, "new", reports[0]["order_status"])
+	assert.Equal(t, "amend_order", responses[0]["method"])
+	assert.Equal(t, true, responses[0]["success"])
+	assert.Equal(t, orderid, responses[0]["result"].(map[string]interface{})["order_id"])
+	assert.Equal(t, 101.0, pendingOrder(tradeintercept, 5).LimitPrice)
+	assert.Equal(t, 2.0, pendingOrder(tradeintercept, 5).OrderQty)
+
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"edit_order","req_id":3,"params":{"order_id":"%s","symbol":"BTC/USD",
+		"order_qty":3,"limit_price":102,"order_userref":6,"validate":true}}`, orderid)))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"edit_order","req_id":3,"success":false,"error":"EOrder:Unknown order"}`))
+	assert.False(t, forward)
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, []string{"restated"}, execTypes(reports))
+	///an edit is a new order, with a new id
+	assert.NotEqual(t, orderid, reports[0]["order_id"])
+	assert.Equal(t, 6.0, reports[0]["order_userref"])
+	assert.Equal(t, reports[0]["order_id"], responses[0]["result"].(map[string]interface{})["order_id"])
+	assert.Equal(t, orderid, responses[0]["result"].(map[string]interface{})["original_order_id"])
+	assert.Nil(t, pendingOrder(tradeintercept, 5))
+	assert.Equal(t, 102.0, pendingOrder(tradeintercept, 6).LimitPrice)
+
+	/// amending an order we don't know about gets the upstream's answer
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"amend_order","req_id":4,"params":{"order_id":"%s","order_qty":2}}`, orderid)))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"amend_order","req_id":4,"success":false,"error":"EOrder:Unknown order"}`))
+	assert.True(t, forward)
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports)+len(responses))
+
+	///req_id is optional
+	orderid = pendingOrder(tradeintercept, 6).OrderId
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"amend_order","params":{"order_id":"%s","order_qty":4}}`, orderid)))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"amend_order","success":false,"error":"EOrder:Unknown order"}`))
+	assert.False(t, forward)
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, []string{"amended"}, execTypes(reports))
+	assert.Nil(t, responses[0]["req_id"])
+	assert.Equal(t, 4.0, pendingOrder(tradeintercept, 6).OrderQty)
+
+	///the qty can't be cut to what has already filled
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":90,"qty":1}],"asks":[{"price":101,"qty":1}]}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"update","data":[{"symbol":"BTC/USD",
+		"bids":[],"asks":[{"price":101,"qty":0}]}]}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, "trade", reports[0]["exec_type"])
+	cumqty := pendingOrder(tradeintercept, 6).CumQty
+	assert.Less(t, cumqty, 4.0)
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"amend_order","req_id":5,"params":{"order_id":"%s","order_qty":%v}}`,
+		orderid, cumqty)))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"amend_order","req_id":5,"success":false,"error":"EOrder:Unknown order"}`))
+	assert.False(t, forward)
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, AMEND_QTY_ERROR, responses[0]["error"])
+	assert.Equal(t, false, responses[0]["success"])
+	assert.Equal(t, 4.0, pendingOrder(tradeintercept, 6).OrderQty)
+
+	///and the amended price and qty have to keep to the pair's rules
+	assetpairs := filepath.Join(t.TempDir(), "asset-pairs.json")
+	assert.Nil(t, os.WriteFile(assetpairs, []byte(`{"error":[],"result":{
+		"XXBTZUSD":{"altname":"XBTUSD","wsname":"XBT/USD","pair_decimals":1,"lot_decimals":8,
+			"ordermin":"0.00005","costmin":"0.5","tick_size":"0.1"}}}`), 0644))
+	registry, err := instruments.NewRegistry(instruments.InstrumentsCfg{AssetPairs: assetpairs, Refresh: true})
+	assert.Nil(t, err)
+	tradeintercept.instruments = registry
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"amend_order","req_id":6,"params":{"order_id":"%s","limit_price":99.05}}`, orderid)))
+	tradeintercept.Southbound([]byte(`{"method":"amend_order","req_id":6,"success":false,"error":"EOrder:Unknown order"}`))
+	_, responses = drain(t, tradeintercept)
+	assert.Equal(t, PRICE_ERROR, responses[0]["error"])
+	assert.Equal(t, 102.0, pendingOrder(tradeintercept, 6).LimitPrice)
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"amend_order","req_id":7,"params":{"order_id":"%s","order_qty":3.000000001}}`, orderid)))
+	tradeintercept.Southbound([]byte(`{"method":"amend_order","req_id":7,"success":false,"error":"EOrder:Unknown order"}`))
+	_, responses = drain(t, tradeintercept)
+	assert.Equal(t, VOLUME_ERROR, responses[0]["error"])
+	assert.Equal(t, 4.0, pendingOrder(tradeintercept, 6).OrderQty)
+}
+
+func TestCancelAll(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true}`)
+	addRestingOrder(t, tradeintercept, 1, 1)
+	addRestingOrder(t, tradeintercept, 2, 2)
+	drain(t, tradeintercept)
+
+	tradeintercept.Northbound([]byte(`{"method":"cancel_all","req_id":3}`))
+	out, forward := tradeintercept.Southbound([]byte(`{"method":"cancel_all","req_id":3,"result":{"count":0},"success":true}`))
+	assert.True(t, forward)
+	resp := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(out, &resp))
+	assert.Equal(t, 2.0, resp["result"].(map[string]interface{})["count"])
+	assert.Equal(t, 3.0, resp["req_id"])
+
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled", "canceled"}, execTypes(reports))
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+	assert.Equal(t, 2, tradeintercept.pastrtrades.len())
+}
+
+func TestCancelAllOrdersAfter(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true}`)
+	timers := useTestTimers(tradeintercept)
+	addRestingOrder(t, tradeintercept, 1, 1)
+	drain(t, tradeintercept)
+
+	tradeintercept.Northbound([]byte(`{"method":"cancel_all_orders_after","req_id":2,"params":{"timeout":1}}`))
+	/// disarm it, then re-arm it, nothing should be canceled in between
+	tradeintercept.Northbound([]byte(`{"method":"cancel_all_orders_after","req_id":3,"params":{"timeout":0}}`))
+	assert.Equal(t, 0, timers.fire())
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, 1, tradeintercept.pendingtrades.len())
+
+	tradeintercept.Northbound([]byte(`{"method":"cancel_all_orders_after","req_id":4,"params":{"timeout":1}}`))
+	assert.Equal(t, time.Second, timers.timers[0].d)
+	assert.Equal(t, 1, timers.fire())
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled"}, execTypes(reports))
+	assert.Equal(t, 1.0, reports[0]["order_userref"])
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+}
+
+func TestPartialFills(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true}`)
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":1}],
+		"asks":[{"price":100,"qty":0.5},{"price":101,"qty":0.5},{"price":102,"qty":1}]}]}`))
+	addOrder(t, tradeintercept, 1, 1, "buy", 101.5, 1.5)
+	drain(t, tradeintercept)
+
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"trade", "trade"}, execTypes(reports))
+	assert.Equal(t, 100.0, reports[0]["last_price"])
+	assert.Equal(t, 0.5, reports[0]["last_qty"])
+	assert.Equal(t, "partially_filled", reports[0]["order_status"])
+	assert.Equal(t, 101.0, reports[1]["last_price"])
+	assert.Equal(t, 1.0, reports[1]["cum_qty"])
+	assert.Equal(t, 0.5, reports[1]["leaves_qty"])
+	assert.Equal(t, 100.5, reports[1]["avg_price"])
+	/// the rest stays on the book
+	assert.Equal(t, 0.5, pendingOrder(tradeintercept, 1).LeavesQty())
+
+	/// a sell the bids don't reach rests
+	addOrder(t, tradeintercept, 2, 2, "sell", 100, 1)
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	for _, report := range reports {
+		if report["exec_type"] == "trade" {
+			assert.NotEqual(t, 2.0, report["order_userref"])
+		}
+	}
+}
+
+func TestQueueFills(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true}`)
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":1}],
+		"asks":[{"price":100,"qty":1}]}]}`))
+	///a passive bid behind the 1 at 99
+	addOrder(t, tradeintercept, 1, 1, "buy", 99, 1)
+	drain(t, tradeintercept)
+
+	///the trade snapshot is history, it doesn't move us
+	tradeintercept.Southbound([]byte(`{"channel":"trade","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"side":"sell","price":99,"qty":5,"ord_type":"market","trade_id":1}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+
+	///a print that clears the queue in front of us and 0.25 of us
+	tradeintercept.Southbound([]byte(`{"channel":"trade","type":"update","data":[{"symbol":"BTC/USD",
+		"side":"sell","price":99,"qty":1.25,"ord_type":"market","trade_id":2}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"trade"}, execTypes(reports))
+	assert.Equal(t, 99.0, reports[0]["last_price"])
+	assert.Equal(t, 0.25, reports[0]["last_qty"])
+	assert.Equal(t, "m", reports[0]["liquidity_ind"])
+
+	///moving the price sends us to the back of the new level
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"amend_order","req_id":2,"params":{"order_id":"%s","limit_price":98}}`,
+		pendingOrder(tradeintercept, 1).OrderId)))
+	tradeintercept.Southbound([]byte(`{"method":"amend_order","req_id":2,"success":false,"error":"EOrder:Unknown order"}`))
+	drain(t, tradeintercept)
+	tradeintercept.Southbound([]byte(`{"channel":"trade","type":"update","data":[{"symbol":"BTC/USD",
+		"side":"sell","price":98,"qty":1,"ord_type":"market","trade_id":3}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"trade", "filled"}, execTypes(reports))
+	assert.Equal(t, 98.0, reports[0]["last_price"])
+	assert.Equal(t, 0.75, reports[0]["last_qty"])
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+}
+
+func TestPrintFills(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "trades"}`)
+	///prints before the order don't count
+	tradeintercept.Southbound([]byte(`{"channel":"trade","type":"update","data":[{"symbol":"BTC/USD",
+		"side":"sell","price":98,"qty":5,"ord_type":"market","trade_id":1}]}`))
+	addOrder(t, tradeintercept, 1, 1, "buy", 99, 1)
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+
+	///above our price, no fill. At or below, fill up to the print's qty at our price
+	tradeintercept.Southbound([]byte(`{"channel":"trade","type":"update","data":[
+		{"symbol":"BTC/USD","side":"buy","price":99.5,"qty":2,"ord_type":"limit","trade_id":2},
+		{"symbol":"BTC/USD","side":"sell","price":99,"qty":0.25,"ord_type":"limit","trade_id":3},
+		{"symbol":"BTC/USD","side":"sell","price":98.5,"qty":2,"ord_type":"market","trade_id":4}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"trade", "trade", "filled"}, execTypes(reports))
+	assert.Equal(t, 0.25, reports[0]["last_qty"])
+	assert.Equal(t, 99.0, reports[0]["last_price"])
+	assert.Equal(t, 0.75, reports[1]["last_qty"])
+	assert.Equal(t, 99.0, reports[1]["last_price"])
+
+	///a sell needs a print at or above its price
+	addOrder(t, tradeintercept, 2, 2, "sell", 101, 1)
+	drain(t, tradeintercept)
+	tradeintercept.Southbound([]byte(`{"channel":"trade","type":"update","data":[
+		{"symbol":"BTC/USD","side":"sell","price":100,"qty":2,"ord_type":"limit","trade_id":5},
+		{"symbol":"BTC/USD","side":"buy","price":101,"qty":0.5,"ord_type":"limit","trade_id":6}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"trade"}, execTypes(reports))
+	assert.Equal(t, 0.5, reports[0]["last_qty"])
+
+	///orders on every connection share a print, it never fills more than its qty
+	other := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "trades"}`)
+	other.orderbooks = tradeintercept.orderbooks
+	addOrder(t, tradeintercept, 3, 3, "buy", 99, 1)
+	addOrder(t, tradeintercept, 4, 4, "buy", 99, 1)
+	addOrder(t, other, 5, 5, "buy", 99, 1)
+	drain(t, tradeintercept)
+	drain(t, other)
+	tradeintercept.Southbound([]byte(`{"channel":"trade","type":"update","data":[
+		{"symbol":"BTC/USD","side":"sell","price":99,"qty":1.5,"ord_type":"limit","trade_id":7}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	other.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"trade", "filled", "trade"}, execTypes(reports))
+	assert.Equal(t, 0.5, reports[2]["last_qty"])
+	reports, _ = drain(t, other)
+	assert.Equal(t, 0, len(reports))
+}
+
+func TestFillModeDefaults(t *testing.T) {
+	tradeinterceptcfg := TradeInterceptCfg{}
+	tradeinterceptcfg.Expand()
+	assert.Equal(t, FILL_IMMEDIATE, tradeinterceptcfg.FillMode)
+	tradeinterceptcfg = TradeInterceptCfg{MatchOrderBook: true}
+	tradeinterceptcfg.Expand()
+	assert.Equal(t, FILL_ORDERBOOK, tradeinterceptcfg.FillMode)
+	tradeinterceptcfg = TradeInterceptCfg{FillMode: FILL_TRADES, MatchOrderBook: true}
+	tradeinterceptcfg.Expand()
+	assert.Equal(t, FILL_TRADES, tradeinterceptcfg.FillMode)
+
+	assert.Panics(t, func() { newTestIntercept(t, `{"Enabled": true, "FillMode": "sometimes"}`) })
+}
+
+// / place an order of any kind given its params, and accept it
+func placeOrder(t *testing.T, tradeintercept *TradeIntercept, reqid int, userref int, params string) {
+	req := fmt.Sprintf(`{"method":"add_order","req_id":%d,"params":{%s,"order_userref":%d,"symbol":"BTC/USD","validate":true}}`,
+		reqid, params, userref)
+	_, forward := tradeintercept.Northbound([]byte(req))
+	assert.True(t, forward)
+	_, forward = tradeintercept.Southbound([]byte(fmt.Sprintf(`{"method":"add_order","req_id":%d,"success":true,"result":{"order_userref":%d}}`, reqid, userref)))
+	assert.True(t, forward)
+}
+
+var lastprintid int64
+
+func printAt(t *testing.T, tradeintercept *TradeIntercept, price float64) []map[string]interface{} {
+	lastprintid++
+	tradeintercept.Southbound([]byte(fmt.Sprintf(`{"channel":"trade","type":"update","data":[{"symbol":"BTC/USD",
+		"side":"sell","price":%f,"qty":0.01,"ord_type":"market","trade_id":%d}]}`, price, lastprintid)))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ := drain(t, tradeintercept)
+	return reports
+}
+
+func TestMarketOrders(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026}`)
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":1}],
+		"asks":[{"price":100,"qty":0.5},{"price":101,"qty":1}]}]}`))
+	/// no limit_price at all
+	placeOrder(t, tradeintercept, 1, 1, `"order_type":"market","side":"buy","order_qty":1`)
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "trade", "trade", "filled"}, execTypes(reports))
+	assert.Equal(t, "market", reports[0]["ord_type"])
+	assert.Nil(t, reports[0]["limit_price"])
+	assert.Equal(t, 100.0, reports[2]["last_price"])
+	assert.Equal(t, 101.0, reports[3]["last_price"])
+	assert.Equal(t, 100.5, reports[4]["avg_price"])
+
+	///market orders never rest - against an empty book it is canceled straight away, and never fills later
+	tradeintercept = newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "orderbook"}`)
+	placeOrder(t, tradeintercept, 2, 2, `"order_type":"market","side":"buy","order_qty":1`)
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "canceled"}, execTypes(reports))
+	assert.Equal(t, "Insufficient liquidity", reports[2]["reason"])
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":1}],"asks":[{"price":100,"qty":0.5}]}]}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+
+	///and what the book can't fill is canceled
+	placeOrder(t, tradeintercept, 3, 3, `"order_type":"market","side":"buy","order_qty":1`)
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "trade", "canceled"}, execTypes(reports))
+	assert.Equal(t, 0.5, reports[3]["cum_qty"])
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+}
+
+func TestTriggerOrders(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026}`)
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":94,"qty":10}],
+		"asks":[{"price":106,"qty":10}]}]}`))
+
+	///a stop loss waits for the last price to fall to its trigger, then sells at market
+	placeOrder(t, tradeintercept, 1, 1, `"order_type":"stop-loss","side":"sell","order_qty":1,
+		"triggers":{"reference":"last","price":95,"price_type":"static"}`)
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	assert.Equal(t, "untriggered", reports[1]["triggers"].(map[string]interface{})["status"])
+	assert.Equal(t, 0, len(printAt(t, tradeintercept, 96)))
+	reports = printAt(t, tradeintercept, 95)
+	assert.Equal(t, []string{"status", "trade", "filled"}, execTypes(reports))
+	triggers := reports[0]["triggers"].(map[string]interface{})
+	assert.Equal(t, "triggered", triggers["status"])
+	assert.Equal(t, 95.0, triggers["actual_price"])
+	assert.Equal(t, 95.0, triggers["last_price"])
+	assert.Equal(t, "new", reports[0]["order_status"])
+	assert.Equal(t, 94.0, reports[1]["last_price"])
+
+	///a take profit limit buy waits for the price to fall, then rests at its limit, here relative to the trigger
+	placeOrder(t, tradeintercept, 2, 2, `"order_type":"take-profit-limit","side":"buy","order_qty":1,
+		"limit_price":-0.5,"limit_price_type":"quote","triggers":{"price":-10,"price_type":"pct"}`)
+	drain(t, tradeintercept)
+	///the trigger is 10% below the last price of 95 when the order was placed
+	assert.Equal(t, 0, len(printAt(t, tradeintercept, 90)))
+	reports = printAt(t, tradeintercept, 85.5)
+	assert.Equal(t, []string{"status", "trade", "filled"}, execTypes(reports))
+	assert.Equal(t, 85.5, reports[0]["triggers"].(map[string]interface{})["actual_price"])
+	assert.Equal(t, 85.0, reports[1]["limit_price"])
+	assert.Equal(t, 85.0, reports[1]["last_price"])
+
+	///a trailing stop follows the price up and sells once it drops back 10%
+	placeOrder(t, tradeintercept, 3, 3, `"order_type":"trailing-stop","side":"sell","order_qty":1,
+		"triggers":{"price":10,"price_type":"pct"}`)
+	drain(t, tradeintercept)
+	assert.Equal(t, 0, len(printAt(t, tradeintercept, 100)))
+	assert.Equal(t, 0, len(printAt(t, tradeintercept, 110)))
+	assert.Equal(t, 0, len(printAt(t, tradeintercept, 99.5)))
+	order := pendingOrder(tradeintercept, 3)
+	assert.Equal(t, 110.0, order.Trigger.PeakPrice)
+	assert.Equal(t, 99.0, order.Trigger.ActualPrice)
+	reports = printAt(t, tradeintercept, 99)
+	assert.Equal(t, []string{"status", "trade", "filled"}, execTypes(reports))
+	assert.Equal(t, 110.0, reports[0]["triggers"].(map[string]interface{})["peak_price"])
+	assert.Equal(t, 94.0, reports[1]["last_price"])
+}
+
+func TestTimeInForce(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "orderbook"}`)
+	timers := useTestTimers(tradeintercept)
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":1}],
+		"asks":[{"price":100,"qty":0.5},{"price":101,"qty":1}]}]}`))
+
+	///ioc takes what it can and cancels the rest
+	placeOrder(t, tradeintercept, 1, 1, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":100.5,"time_in_force":"ioc"`)
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "trade", "canceled"}, execTypes(reports))
+	assert.Equal(t, 0.5, reports[2]["last_qty"])
+	assert.Equal(t, "Immediate or cancel", reports[3]["reason"])
+	assert.Equal(t, 0.5, reports[3]["cum_qty"])
+	assert.Equal(t, "ioc", reports[3]["time_in_force"])
+
+	///fok doesn't trade at all unless it can all trade
+	placeOrder(t, tradeintercept, 2, 2, `"order_type":"limit","side":"buy","order_qty":2,"limit_price":101,"time_in_force":"fok"`)
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "canceled"}, execTypes(reports))
+	assert.Equal(t, "Fill or kill", reports[2]["reason"])
+	placeOrder(t, tradeintercept, 3, 3, `"order_type":"limit","side":"buy","order_qty":1.5,"limit_price":101,"time_in_force":"fok"`)
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "trade", "trade", "filled"}, execTypes(reports))
+
+	///gtd rests until it expires
+	expiretime := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	placeOrder(t, tradeintercept, 4, 4, fmt.Sprintf(`"order_type":"limit","side":"buy","order_qty":1,"limit_price":90,
+		"time_in_force":"gtd","expire_time":"%s"`, expiretime))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	assert.NotNil(t, reports[1]["expire_time"])
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.InDelta(t, time.Hour, timers.timers[0].d, float64(time.Minute))
+	assert.Equal(t, 1, timers.fire())
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"expired"}, execTypes(reports))
+	assert.Equal(t, "expired", reports[0]["order_status"])
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+
+	///gtd without an expire_time, or with one that isn't a time, is rejected and never exists
+	resp := addOrderResponse(t, tradeintercept, 5, 5, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90,"time_in_force":"gtd"`)
+	assert.Equal(t, false, resp["success"])
+	assert.Equal(t, EXPIRE_TIME_ERROR, resp["error"])
+	resp = addOrderResponse(t, tradeintercept, 6, 6, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90,
+		"time_in_force":"gtd","expire_time":"tomorrow"`)
+	assert.Equal(t, EXPIRE_TIME_ERROR, resp["error"])
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+
+	///closing the connection stops the expiry timers, and one already going off doesn't wait to send
+	placeOrder(t, tradeintercept, 7, 7, fmt.Sprintf(`"order_type":"limit","side":"buy","order_qty":1,"limit_price":90,
+		"time_in_force":"gtd","expire_time":"%s"`, expiretime))
+	drain(t, tradeintercept)
+	expiry := timers.timers[0]
+	for len(tradeintercept.expiries) < cap(tradeintercept.expiries) {
+		tradeintercept.expiries <- pendingOrder(tradeintercept, 7)
+	}
+	tradeintercept.Close()
+	assert.True(t, expiry.stopped)
+	expiry.f()
+}
+
+// / send an add_order for an order and return the response the trading engine would see
+func addOrderResponse(t *testing.T, tradeintercept *TradeIntercept, reqid int, userref int, params string) map[string]interface{} {
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"add_order","req_id":%d,"params":{%s,"order_userref":%d,
+		"symbol":"BTC/USD","validate":true}}`, reqid, params, userref)))
+	out, forward := tradeintercept.Southbound([]byte(fmt.Sprintf(`{"method":"add_order","req_id":%d,"success":true,
+		"result":{"order_userref":%d}}`, reqid, userref)))
+	assert.True(t, forward)
+	resp := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(out, &resp))
+	return resp
+}
+
+func TestPostOnlyAndReduceOnly(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "orderbook"}`)
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":1}],
+		"asks":[{"price":100,"qty":1}]}]}`))
+
+	///a post only order that would take liquidity is rejected, and never exists
+	resp := addOrderResponse(t, tradeintercept, 1, 1, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":100,"post_only":true`)
+	assert.Equal(t, false, resp["success"])
+	assert.Equal(t, POST_ONLY_ERROR, resp["error"])
+	assert.Equal(t, 1.0, resp["req_id"])
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+	///one that doesn't cross rests
+	resp = addOrderResponse(t, tradeintercept, 2, 2, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":99.5,"post_only":true`)
+	assert.Equal(t, true, resp["success"])
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	assert.Equal(t, true, reports[1]["post_only"])
+
+	///one bad order rejects the whole batch
+	tradeintercept.Northbound([]byte(`{"method":"batch_add","req_id":3,"params":{"symbol":"BTC/USD","validate":true,"orders":[
+		{"order_type":"limit","side":"buy","limit_price":98,"order_qty":1,"order_userref":3},
+		{"order_type":"limit","side":"sell","limit_price":99,"order_qty":1,"order_userref":4,"post_only":true}]}}`))
+	out, _ := tradeintercept.Southbound([]byte(`{"method":"batch_add","req_id":3,"success":true,
+		"result":[{"order_userref":3},{"order_userref":4}]}`))
+	assert.Contains(t, string(out), POST_ONLY_ERROR)
+	assert.Equal(t, 1, tradeintercept.pendingtrades.len())
+
+	///reduce only needs a position to reduce
+	resp = addOrderResponse(t, tradeintercept, 5, 5, `"order_type":"limit","side":"sell","order_qty":1,"limit_price":99,"reduce_only":true,"margin":true`)
+	assert.Equal(t, REDUCE_ONLY_ERROR, resp["error"])
+	placeOrder(t, tradeintercept, 6, 6, `"order_type":"market","side":"buy","order_qty":0.5,"margin":true`)
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	drain(t, tradeintercept)
+	assert.Equal(t, 0.5, tradeintercept.account.Position("BTC/USD"))
+	///and can't be bigger than it
+	resp = addOrderResponse(t, tradeintercept, 7, 7, `"order_type":"limit","side":"sell","order_qty":2,"limit_price":105,"reduce_only":true,"margin":true`)
+	assert.Equal(t, true, resp["success"])
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 0.5, reports[1]["order_qty"])
+	///a buy can't reduce a long
+	resp = addOrderResponse(t, tradeintercept, 8, 8, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90,"reduce_only":true,"margin":true`)
+	assert.Equal(t, REDUCE_ONLY_ERROR, resp["error"])
+}
+
+func TestFees(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "MakerFee": 0.001, "TakerFee": 0.002, "FillMode": "orderbook",
+		"FeeTiers": [{"Volume": 150, "MakerFee": 0, "TakerFee": 0.001}]}`)
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":10}],
+		"asks":[{"price":100,"qty":10}]}]}`))
+	trades := func() []map[string]interface{} {
+		tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+		reports, _ := drain(t, tradeintercept)
+		trades := make([]map[string]interface{}, 0)
+		for _, report := range reports {
+			if report["exec_type"] == "trade" {
+				trades = append(trades, report)
+			}
+		}
+		return trades
+	}
+
+	///crossing the book takes liquidity
+	placeOrder(t, tradeintercept, 1, 1, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":100`)
+	fills := trades()
+	assert.Equal(t, 1, len(fills))
+	assert.Equal(t, "t", fills[0]["liquidity_ind"])
+	fee := fills[0]["fees"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "USD", fee["asset"])
+	assert.InDelta(t, 0.2, fee["qty"], 1e-9)
+
+	///resting provides it, and the fee can be taken in the base asset
+	placeOrder(t, tradeintercept, 2, 2, `"order_type":"limit","side":"sell","order_qty":1,"limit_price":101,"fee_preference":"base"`)
+	assert.Equal(t, 0, len(trades()))
+	tradeintercept.Southbound([]byte(`{"channel":"trade","type":"update","data":[{"symbol":"BTC/USD",
+		"side":"buy","price":101,"qty":1,"ord_type":"market","trade_id":1}]}`))
+	fills = trades()
+	assert.Equal(t, 1, len(fills))
+	assert.Equal(t, "m", fills[0]["liquidity_ind"])
+	fee = fills[0]["fees"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "BTC", fee["asset"])
+	assert.InDelta(t, 0.001, fee["qty"], 1e-9)
+	assert.InDelta(t, 201, tradeintercept.account.Volume(), 1e-9)
+
+	///with 201 traded we are into the next tier
+	placeOrder(t, tradeintercept, 3, 3, `"order_type":"market","side":"buy","order_qty":1`)
+	fills = trades()
+	assert.Equal(t, "t", fills[0]["liquidity_ind"])
+	fee = fills[0]["fees"].([]interface{})[0].(map[string]interface{})
+	assert.InDelta(t, 0.1, fee["qty"], 1e-9)
+}
+
+func TestBalances(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "MakerFee": 0.001, "TakerFee": 0.002}`)
+	tradeintercept.account = accounts.NewAccount("test", accounts.BalancesCfg{Enabled: true,
+		Seed: map[string]map[string]float64{"test": {"BTC": 1, "USD": 1000}}}, accounts.MarginCfg{})
+
+	tradeintercept.Northbound([]byte(`{"method":"subscribe","params":{"channel":"balances","snapshot":true}}`))
+	tradeintercept.Southbound([]byte(`{"method":"subscribe","result":{"channel":"balances"},"success":true}`))
+	_, responses := drain(t, tradeintercept)
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, "snapshot", responses[0]["type"])
+	snapshot := responses[0]["data"].([]interface{})
+	assert.Equal(t, "BTC", snapshot[0].(map[string]interface{})["asset"])
+	assert.Equal(t, 1.0, snapshot[0].(map[string]interface{})["balance"])
+	assert.Equal(t, 1000.0, snapshot[1].(map[string]interface{})["balance"])
+
+	///the real account's balances are replaced
+	_, forward := tradeintercept.Southbound([]byte(`{"channel":"balances","type":"update","data":[{"asset":"USD","balance":5}]}`))
+	assert.False(t, forward)
+
+	///a fill moves both assets, less the fee
+	resp := addOrderResponse(t, tradeintercept, 1, 1, `"order_type":"limit","side":"buy","order_qty":5,"limit_price":100`)
+	assert.Equal(t, true, resp["success"])
+	_, responses = drain(t, tradeintercept)
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, "update", responses[0]["type"])
+	entries := responses[0]["data"].([]interface{})
+	base := entries[0].(map[string]interface{})
+	quote := entries[1].(map[string]interface{})
+	assert.Equal(t, "BTC", base["asset"])
+	assert.Equal(t, 5.0, base["amount"])
+	assert.Equal(t, 6.0, base["balance"])
+	assert.Equal(t, -500.0, quote["amount"])
+	assert.Equal(t, 0.5, quote["fee"])
+	assert.Equal(t, 499.5, quote["balance"])
+	assert.Equal(t, 499.5, tradeintercept.account.Balance("USD"))
+
+	///without the funds, orders are rejected
+	resp = addOrderResponse(t, tradeintercept, 2, 2, `"order_type":"limit","side":"buy","order_qty":5,"limit_price":100`)
+	assert.Equal(t, FUNDS_ERROR, resp["error"])
+	resp = addOrderResponse(t, tradeintercept, 3, 3, `"order_type":"limit","side":"sell","order_qty":7,"limit_price":100`)
+	assert.Equal(t, FUNDS_ERROR, resp["error"])
+	///margin orders don't need the spot funds
+	resp = addOrderResponse(t, tradeintercept, 4, 4, `"order_type":"limit","side":"sell","order_qty":7,"limit_price":100,"margin":true`)
+	assert.Equal(t, true, resp["success"])
+	assert.Equal(t, 6.0, tradeintercept.account.Balance("BTC"))
+
+	///overlaid on the real balances instead
+	tradeintercept.account = accounts.NewAccount("test", accounts.BalancesCfg{Enabled: true, Overlay: true}, accounts.MarginCfg{})
+	tradeintercept.account.Change("USD", -10)
+	out, forward := tradeintercept.Southbound([]byte(`{"channel":"balances","type":"snapshot","data":[{"asset":"USD","balance":100}]}`))
+	assert.True(t, forward)
+	assert.Contains(t, string(out), `"balance":90`)
+}
+
+func TestSharedFunds(t *testing.T) {
+	account := accounts.NewAccount("test", accounts.BalancesCfg{Enabled: true,
+		Seed: map[string]map[string]float64{"test": {"USD": 1000}}}, accounts.MarginCfg{})
+	first := newTestIntercept(t, `{"Enabled": true, "MatchOrderBook": true}`)
+	second := newTestIntercept(t, `{"Enabled": true, "MatchOrderBook": true}`)
+	first.account, second.account = account, account
+
+	///two connections on the same account can't both spend the whole balance
+	resp := addOrderResponse(t, first, 1, 1, `"order_type":"limit","side":"buy","order_qty":12,"limit_price":50`)
+	assert.Equal(t, true, resp["success"])
+	assert.Equal(t, 600.0, account.Held("USD"))
+	resp = addOrderResponse(t, second, 1, 1, `"order_type":"limit","side":"buy","order_qty":12,"limit_price":50`)
+	assert.Equal(t, FUNDS_ERROR, resp["error"])
+	resp = addOrderResponse(t, second, 2, 2, `"order_type":"limit","side":"buy","order_qty":8,"limit_price":50`)
+	assert.Equal(t, true, resp["success"])
+	assert.Equal(t, 1000.0, account.Held("USD"))
+
+	///canceling frees the funds
+	first.Northbound([]byte(`{"method":"cancel_order","req_id":3,"params":{"order_userref":[1]}}`))
+	first.Southbound([]byte(`{"method":"cancel_order","req_id":3,"success":false,"error":"EOrder:Unknown order"}`))
+	assert.Equal(t, 400.0, account.Held("USD"))
+
+	///a batch can't spend the same funds twice either
+	first.Northbound([]byte(`{"method":"batch_add","req_id":4,"params":{"symbol":"BTC/USD","validate":true,"orders":[
+		{"order_type":"limit","side":"buy","limit_price":50,"order_qty":8,"order_userref":4},
+		{"order_type":"limit","side":"buy","limit_price":50,"order_qty":8,"order_userref":5}]}}`))
+	out, _ := first.Southbound([]byte(`{"method":"batch_add","req_id":4,"success":true,
+		"result":[{"order_userref":4},{"order_userref":5}]}`))
+	assert.Contains(t, string(out), FUNDS_ERROR)
+	assert.Equal(t, 400.0, account.Held("USD"))
+	first.Northbound([]byte(`{"method":"batch_add","req_id":5,"params":{"symbol":"BTC/USD","validate":true,"orders":[
+		{"order_type":"limit","side":"buy","limit_price":50,"order_qty":6,"order_userref":6},
+		{"order_type":"limit","side":"buy","limit_price":50,"order_qty":6,"order_userref":7}]}}`))
+	out, _ = first.Southbound([]byte(`{"method":"batch_add","req_id":5,"success":true,
+		"result":[{"order_userref":6},{"order_userref":7}]}`))
+	assert.NotContains(t, string(out), FUNDS_ERROR)
+	assert.Equal(t, 1000.0, account.Held("USD"))
+}
+
+func TestMarginPositions(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026}`)
+	tradeintercept.account = accounts.NewAccount("test", accounts.BalancesCfg{},
+		accounts.MarginCfg{Enabled: true, Collateral: 100})
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":10}],
+		"asks":[{"price":101,"qty":10}]}]}`))
+
+	///5x leverage - 404 of BTC needs 80.8 of margin
+	resp := addOrderResponse(t, tradeintercept, 1, 1, `"order_type":"limit","side":"buy","order_qty":4,"limit_price":101,"margin":true`)
+	assert.Equal(t, true, resp["success"])
+	drain(t, tradeintercept)
+	assert.Equal(t, 4.0, tradeintercept.account.Position("BTC/USD"))
+	///the fee comes off the collateral
+	assert.InDelta(t, 100-404*0.0026, tradeintercept.account.MarginStatus(tradeintercept.markPrice).Collateral, 1e-9)
+	///there isn't enough left for another 1
+	resp = addOrderResponse(t, tradeintercept, 2, 2, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":101,"margin":true`)
+	assert.Equal(t, MARGIN_ERROR, resp["error"])
+	///but reducing the position needs none
+	resp = addOrderResponse(t, tradeintercept, 3, 3, `"order_type":"limit","side":"sell","order_qty":1,"limit_price":110,"margin":true`)
+	assert.Equal(t, true, resp["success"])
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "trade", "filled"}, execTypes(reports))
+	assert.Equal(t, 3.0, tradeintercept.account.Position("BTC/USD"))
+
+	///the market falls until the margin level is below 80%, the client gets a margin call
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"update","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":0},{"price":79,"qty":10}],
+		"asks":[{"price":101,"qty":0},{"price":81,"qty":10}]}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, responses := drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, "margin_call", responses[0]["channel"])
+	margincall := responses[0]["data"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "test", margincall["account"])
+	assert.Less(t, margincall["margin_level"], 80.0)
+	assert.Greater(t, margincall["margin_level"], 40.0)
+	///only once
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	_, responses = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(responses))
+
+	///then below 40%, the position is closed out at the mid price
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"update","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":79,"qty":0},{"price":69,"qty":10}],
+		"asks":[{"price":81,"qty":0},{"price":71,"qty":10}]}]}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "trade", "filled"}, execTypes(reports))
+	assert.Equal(t, "sell", reports[2]["side"])
+	assert.Equal(t, 3.0, reports[2]["last_qty"])
+	assert.Equal(t, 70.0, reports[2]["last_price"])
+	assert.Equal(t, true, reports[2]["liquidated"])
+	assert.Equal(t, 0.0, tradeintercept.account.Position("BTC/USD"))
+}
+
+func TestInstruments(t *testing.T) {
+	assetpairs := filepath.Join(t.TempDir(), "asset-pairs.json")
+	assert.Nil(t, os.WriteFile(assetpairs, []byte(`{"error":[],"result":{
+		"XXBTZUSD":{"altname":"XBTUSD","wsname":"XBT/USD","pair_decimals":1,"lot_decimals":8,
+			"ordermin":"0.00005","costmin":"0.5","tick_size":"0.1"}}}`), 0644))
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "orderbook", "MaxOpenOrders": 3}`)
+	registry, err := instruments.NewRegistry(instruments.InstrumentsCfg{AssetPairs: assetpairs, Refresh: true})
+	assert.Nil(t, err)
+	tradeintercept.instruments = registry
+
+	for _, test := range []struct {
+		params string
+		reason string
+	}{
+		{`"order_type":"limit","side":"buy","order_qty":1,"limit_price":100.05`, PRICE_ERROR},
+		{`"order_type":"stop-loss","side":"sell","order_qty":1,"triggers":{"price":90.01}`, PRICE_ERROR},
+		{`"order_type":"limit","side":"buy","order_qty":0.000000001,"limit_price":100`, VOLUME_ERROR},
+		{`"order_type":"limit","side":"buy","order_qty":0.00001,"limit_price":100`, VOLUME_MINIMUM_ERROR},
+		{`"order_type":"limit","side":"buy","order_qty":0.001,"limit_price":100`, COST_MINIMUM_ERROR},
+		{`"order_type":"limit","side":"buy","order_qty":1,"limit_price":100,"margin":true`, MARGIN_PAIR_ERROR},
+	} {
+		resp := addOrderResponse(t, tradeintercept, 1, 1, test.params)
+		assert.Equal(t, false, resp["success"], test.params)
+		assert.Equal(t, test.reason, resp["error"], test.params)
+		assert.Equal(t, "add_order", resp["method"])
+	}
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+
+	///pairs that aren't known aren't checked
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":2,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":100.001,"order_userref":2,"symbol":"SOL/USD","validate":true}}`))
+	out, _ := tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":2,"success":true,"result":{"order_userref":2}}`))
+	assert.Contains(t, string(out), `"success":true`)
+	///unless the registry is strict
+	registry, err = instruments.NewRegistry(instruments.InstrumentsCfg{AssetPairs: assetpairs, Refresh: true, Strict: true})
+	assert.Nil(t, err)
+	tradeintercept.instruments = registry
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":2,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":100,"order_userref":2,"symbol":"ETH/USD","validate":true}}`))
+	out, _ = tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":2,"success":true,"result":{"order_userref":2}}`))
+	assert.Contains(t, string(out), UNKNOWN_PAIR_ERROR)
+	///until the instrument channel tells us about it
+	tradeintercept.Southbound([]byte(`{"channel":"instrument","type":"update","data":{"assets":[],"pairs":[
+		{"symbol":"ETH/USD","base":"ETH","quote":"USD","status":"online","qty_precision":8,"qty_increment":0.00000001,
+		"price_precision":2,"price_increment":0.01,"cost_min":0.5,"qty_min":0.002,"marginable":true}]}}`))
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":2,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":100.01,"order_userref":2,"symbol":"ETH/USD","validate":true,"margin":true}}`))
+	out, _ = tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":2,"success":true,"result":{"order_userref":2}}`))
+	assert.Contains(t, string(out), `"success":true`)
+
+	///relative prices aren't held to the tick size
+	resp := addOrderResponse(t, tradeintercept, 3, 3, `"order_type":"trailing-stop","side":"sell","order_qty":1,
+		"triggers":{"price":0.55,"price_type":"pct"}`)
+	assert.Equal(t, true, resp["success"])
+	resp = addOrderResponse(t, tradeintercept, 4, 4, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":100.1`)
+	assert.Equal(t, true, resp["success"])
+	///only 3 open orders allowed on the pair, counting the account's other connections
+	other := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "orderbook", "MaxOpenOrders": 3}`)
+	other.account = tradeintercept.account
+	resp = addOrderResponse(t, other, 5, 5, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":100`)
+	assert.Equal(t, true, resp["success"])
+	resp = addOrderResponse(t, tradeintercept, 6, 6, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":100`)
+	assert.Equal(t, ORDERS_LIMIT_ERROR, resp["error"])
+	///the other pairs have their own limit
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":7,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":100,"order_userref":7,"symbol":"ETH/USD","validate":true}}`))
+	out, _ = tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":7,"success":true,"result":{"order_userref":7}}`))
+	assert.Contains(t, string(out), `"success":true`)
+	///and canceling one makes room
+	drain(t, other)
+	other.Northbound([]byte(`{"method":"cancel_order","req_id":8,"params":{"order_userref":[5]}}`))
+	other.Southbound([]byte(`{"method":"cancel_order","req_id":8,"success":false,"error":"EOrder:Unknown order"}`))
+	resp = addOrderResponse(t, tradeintercept, 9, 9, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":100`)
+	assert.Equal(t, true, resp["success"])
+}
+
+func TestErrorRules(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "orderbook", "ErrorRules": [
+		{"Method": "add_order", "Side": "sell", "EveryNth": 2, "Action": "error", "Error": "EGeneral:Internal error"},
+		{"Method": "add_order", "MinUserref": 100, "MaxUserref": 199, "Action": "noexec"},
+		{"Method": "add_order", "MinUserref": 200, "MaxUserref": 299, "Action": "drop"},
+		{"Method": "cancel_order", "Action": "delay", "Delay": "50ms"}]}`)
+	timers := useTestTimers(tradeintercept)
+
+	///every 2nd sell gets the error instead of going upstream
+	placeOrder(t, tradeintercept, 1, 1, `"order_type":"limit","side":"sell","order_qty":1,"limit_price":110`)
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	_, forward := tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":2,"params":{"order_type":"limit",
+		"side":"sell","order_qty":1,"limit_price":110,"order_userref":2,"symbol":"BTC/USD","validate":true}}`))
+	assert.False(t, forward)
+	reports, responses := drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, "EGeneral:Internal error", responses[0]["error"])
+	assert.Equal(t, false, responses[0]["success"])
+	assert.Equal(t, 2.0, responses[0]["req_id"])
+
+	///success, but nothing happens
+	resp := addOrderResponse(t, tradeintercept, 3, 100, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90`)
+	assert.Equal(t, true, resp["success"])
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, 0, len(reports))
+	assert.Nil(t, pendingOrder(tradeintercept, 100))
+
+	///the order goes live but the response never comes
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":4,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":90,"order_userref":200,"symbol":"BTC/USD","validate":true}}`))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":4,"success":true,"result":{"order_userref":200}}`))
+	assert.False(t, forward)
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	assert.Equal(t, 0, len(tradeintercept.heldreqs), "released once the response has gone")
+
+	///hit, but the upstream never answers - the same req_id used again, and not hit, gets its response
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":4,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":90,"order_userref":201,"symbol":"BTC/USD","validate":true}}`))
+	tradeintercept.Southbound([]byte(`{"channel":"heartbeat"}`))
+	assert.Equal(t, 1, len(tradeintercept.heldreqs))
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":4,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":90,"order_userref":6,"symbol":"BTC/USD","validate":true}}`))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":4,"success":true,"result":{"order_userref":6}}`))
+	assert.True(t, forward)
+	assert.Equal(t, 0, len(tradeintercept.heldreqs))
+	///and a response to a different method with the req_id isn't touched
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":7,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":90,"order_userref":203,"symbol":"BTC/USD","validate":true}}`))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"amend_order","req_id":7,"success":false,"error":"EOrder:Unknown order"}`))
+	assert.True(t, forward)
+	///and no rules for requests without a req_id
+	tradeintercept.Northbound([]byte(`{"method":"add_order","params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":90,"order_userref":202,"symbol":"BTC/USD","validate":true}}`))
+	_, forward = tradeintercept.Southbound([]byte(`{"method":"add_order","success":true,"result":{"order_userref":202}}`))
+	assert.True(t, forward)
+	drain(t, tradeintercept)
+
+	///the cancel happens, the response turns up later
+	tradeintercept.Northbound([]byte(`{"method":"cancel_order","req_id":5,"params":{"order_userref":[200]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"cancel_order","req_id":5,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled"}, execTypes(reports))
+	assert.Equal(t, 0, len(responses))
+	assert.Equal(t, 50*time.Millisecond, timers.timers[0].d)
+	assert.Equal(t, 1, timers.fire())
+	_, responses = drain(t, tradeintercept)
+	assert.Equal(t, 1, len(responses))
+	assert.Equal(t, "cancel_order", responses[0]["method"])
+	assert.Equal(t, true, responses[0]["success"])
+
+	///a delayed response doesn't wait to send once the connection has gone
+	tradeintercept.Northbound([]byte(`{"method":"cancel_order","req_id":8,"params":{"order_userref":[6]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"cancel_order","req_id":8,"success":false,"error":"EOrder:Unknown order"}`))
+	drain(t, tradeintercept)
+	assert.Equal(t, 1, len(timers.timers))
+	for len(tradeintercept.responses) < cap(tradeintercept.responses) {
+		tradeintercept.responses <- delayedResp(`{}`)
+	}
+	tradeintercept.Close()
+	assert.Equal(t, 1, timers.fire())
+}
+
+// / testTimers stands in for time.AfterFunc, its timers only go off when the test fires them
+type testTimers struct {
+	timers []*testTimer
+}
+
+type testTimer struct {
+	d       time.Duration
+	f       func()
+	stopped bool
+}
+
+func (p *testTimer) Stop() bool {
+	running := !p.stopped
+	p.stopped = true
+	return running
+}
+
+func useTestTimers(tradeintercept *TradeIntercept) *testTimers {
+	timers := &testTimers{}
+	tradeintercept.afterfunc = func(d time.Duration, f func()) timer {
+		t := &testTimer{d: d, f: f}
+		timers.timers = append(timers.timers, t)
+		return t
+	}
+	return timers
+}
+
+// / fire sets off every timer that hasn't been stopped and forgets them all, returning how many went off
+func (p *testTimers) fire() int {
+	fired := 0
+	timers := p.timers
+	p.timers = nil
+	for _, t := range timers {
+		if !t.stopped {
+			t.stopped = true
+			t.f()
+			fired++
+		}
+	}
+	return fired
+}
+
+type testIds struct {
+	n int64
+}
+
+func (p *testIds) OrderId() string  { p.n++; return fmt.Sprint("ORDER", p.n) }
+func (p *testIds) ExecId() string   { p.n++; return fmt.Sprint("EXEC", p.n) }
+func (p *testIds) LedgerId() string { p.n++; return fmt.Sprint("LEDGER", p.n) }
+func (p *testIds) AmendId() string  { p.n++; return fmt.Sprint("AMEND", p.n) }
+func (p *testIds) TradeId() int64   { p.n++; return p.n }
+
+func TestIds(t *testing.T) {
+	///the same seed, the same ids
+	ids := NewKrakenIds(42)
+	orderid := ids.OrderId()
+	assert.Regexp(t, `^O[A-Z2-7]{5}-[A-Z2-7]{5}-[A-Z2-7]{6}$`, orderid)
+	assert.Regexp(t, `^T[A-Z2-7]{5}-[A-Z2-7]{5}-[A-Z2-7]{6}$`, ids.ExecId())
+	assert.Regexp(t, `^L[A-Z2-7]{5}-[A-Z2-7]{5}-[A-Z2-7]{6}$`, ids.LedgerId())
+	tradeid := ids.TradeId()
+	assert.Equal(t, tradeid+1, ids.TradeId())
+	assert.Equal(t, orderid, NewKrakenIds(42).OrderId())
+	assert.NotEqual(t, orderid, NewKrakenIds(43).OrderId())
+
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true, "IdSeed": 42}`)
+	resp := addOrderResponse(t, tradeintercept, 1, 1, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90`)
+	assert.Equal(t, orderid, resp["result"].(map[string]interface{})["order_id"])
+	drain(t, tradeintercept)
+	///the cancel response has the order id too
+	tradeintercept.Northbound([]byte(`{"method":"cancel_order","req_id":2,"params":{"order_userref":[1]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"cancel_order","req_id":2,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, responses := drain(t, tradeintercept)
+	assert.Equal(t, orderid, reports[0]["order_id"])
+	assert.Equal(t, orderid, responses[0]["result"].(map[string]interface{})["order_id"])
+
+	///connections sharing a generator never get the same ids, even from the same seed
+	shared := NewKrakenIds(42)
+	other := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true, "IdSeed": 42}`)
+	other.SetIdGenerator(shared)
+	again := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true, "IdSeed": 42}`)
+	again.SetIdGenerator(shared)
+	resp = addOrderResponse(t, other, 1, 1, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90`)
+	assert.Equal(t, orderid, resp["result"].(map[string]interface{})["order_id"])
+	resp = addOrderResponse(t, again, 1, 1, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90`)
+	assert.NotEqual(t, orderid, resp["result"].(map[string]interface{})["order_id"])
+
+	///or plug in your own
+	tradeintercept.SetIdGenerator(&testIds{})
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":1}],"asks":[{"price":100,"qty":1}]}]}`))
+	placeOrder(t, tradeintercept, 3, 3, `"order_type":"market","side":"buy","order_qty":1`)
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new", "trade", "filled"}, execTypes(reports))
+	assert.Equal(t, "ORDER1", reports[2]["order_id"])
+	assert.Equal(t, "EXEC2", reports[2]["exec_id"])
+	assert.Equal(t, 3.0, reports[2]["trade_id"])
+}
+
+func TestClOrdId(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "MatchOrderBook": true}`)
+	tradeintercept.Southbound([]byte(`{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD",
+		"bids":[{"price":99,"qty":1}],"asks":[{"price":100,"qty":1}]}]}`))
+
+	///the cl_ord_id is echoed in the response and every report
+	resp := addOrderResponse(t, tradeintercept, 1, 0, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90,"cl_ord_id":"my-order-1"`)
+	assert.Equal(t, "my-order-1", resp["result"].(map[string]interface{})["cl_ord_id"])
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	for _, report := range reports {
+		assert.Equal(t, "my-order-1", report["cl_ord_id"])
+	}
+	order := tradeintercept.pendingtrades.getByClOrdId("my-order-1")
+	assert.NotNil(t, order)
+	assert.Equal(t, order, tradeintercept.pendingtrades.get(order.OrderId))
+
+	///amend by cl_ord_id
+	tradeintercept.Northbound([]byte(`{"method":"amend_order","req_id":2,"params":{"cl_ord_id":"my-order-1","limit_price":91}}`))
+	tradeintercept.Southbound([]byte(`{"method":"amend_order","req_id":2,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, responses := drain(t, tradeintercept)
+	assert.Equal(t, 91.0, order.LimitPrice)
+	assert.Equal(t, "my-order-1", reports[0]["cl_ord_id"])
+	assert.Equal(t, "my-order-1", responses[0]["result"].(map[string]interface{})["cl_ord_id"])
+
+	///cancel by cl_ord_id
+	tradeintercept.Northbound([]byte(`{"method":"cancel_order","req_id":3,"params":{"cl_ord_id":["my-order-1"]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"cancel_order","req_id":3,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled"}, execTypes(reports))
+	assert.Equal(t, "my-order-1", reports[0]["cl_ord_id"])
+	assert.Equal(t, order.OrderId, responses[0]["result"].(map[string]interface{})["order_id"])
+	assert.Equal(t, "my-order-1", responses[0]["result"].(map[string]interface{})["cl_ord_id"])
+	assert.Nil(t, tradeintercept.pendingtrades.getByClOrdId("my-order-1"))
+	assert.Equal(t, order, tradeintercept.pastrtrades.getByClOrdId("my-order-1"))
+
+	///cancel by order_id
+	addOrderResponse(t, tradeintercept, 4, 0, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90`)
+	drain(t, tradeintercept)
+	order = pendingOrder(tradeintercept, 0)
+	assert.Nil(t, order, "userref 0 isn't an id")
+	order = tradeintercept.pendingtrades.all()[0]
+	tradeintercept.Northbound([]byte(fmt.Sprintf(`{"method":"cancel_order","req_id":5,"params":{"order_id":["%s"]}}`, order.OrderId)))
+	tradeintercept.Southbound([]byte(`{"method":"cancel_order","req_id":5,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled"}, execTypes(reports))
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+
+	///userrefs needn't be unique - a cancel by userref cancels all of them
+	placeOrder(t, tradeintercept, 6, 7, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90`)
+	placeOrder(t, tradeintercept, 7, 7, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":91`)
+	drain(t, tradeintercept)
+	assert.Equal(t, 2, len(tradeintercept.pendingtrades.getByUserref(7)))
+	tradeintercept.Northbound([]byte(`{"method":"cancel_order","req_id":8,"params":{"order_userref":[7]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"cancel_order","req_id":8,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled", "canceled"}, execTypes(reports))
+	assert.Equal(t, 2, len(responses))
+	assert.Equal(t, 0, tradeintercept.pendingtrades.len())
+
+	///batch cancel by cl_ord_id
+	addOrderResponse(t, tradeintercept, 9, 0, `"order_type":"limit","side":"buy","order_qty":1,"limit_price":90,"cl_ord_id":"my-order-2"`)
+	drain(t, tradeintercept)
+	tradeintercept.Northbound([]byte(`{"method":"batch_cancel","req_id":10,"params":{"orders":[],"cl_ord_id":["my-order-2"]}}`))
+	tradeintercept.Southbound([]byte(`{"method":"batch_cancel","req_id":10,"success":false,"error":"EOrder:Unknown order"}`))
+	reports, responses = drain(t, tradeintercept)
+	assert.Equal(t, []string{"canceled"}, execTypes(reports))
+	assert.Equal(t, 1.0, responses[0]["orders_cancelled"])
+}
+
+func TestOrderStore(t *testing.T) {
+	store := newOrderStore(2)
+	first := &Order{OrderId: "A", ClOrdId: "a", OrderUserref: 1}
+	second := &Order{OrderId: "B", OrderUserref: 1}
+	store.add(first)
+	store.add(second)
+	assert.Equal(t, []*Order{first, second}, store.getByUserref(1))
+	assert.Equal(t, first, store.find("", "a"))
+	assert.Equal(t, second, store.find("B", ""))
+
+	store.reindex(second, func() { second.OrderId = "C" })
+	assert.Nil(t, store.get("B"))
+	assert.Equal(t, second, store.get("C"))
+
+	///past the limit the oldest goes
+	store.add(&Order{OrderId: "D"})
+	assert.Equal(t, 2, store.len())
+	assert.Nil(t, store.get("A"))
+	assert.Nil(t, store.getByClOrdId("a"))
+	assert.Equal(t, []*Order{second}, store.getByUserref(1))
+	assert.False(t, store.remove(first))
+}
+
+func TestAddOrderMatching(t *testing.T) {
+	tradeintercept := newTestIntercept(t, `{"Enabled": true, "FeeRatio": 0.0026, "FillMode": "orderbook"}`)
+
+	///no req_id on either, and the responses come back the other way round - matched by order_userref
+	tradeintercept.Northbound([]byte(`{"method":"add_order","params":{"order_type":"limit","side":"buy","order_qty":1,
+		"limit_price":90,"order_userref":1,"symbol":"BTC/USD","validate":true}}`))
+	tradeintercept.Northbound([]byte(`{"method":"add_order","params":{"order_type":"limit","side":"buy","order_qty":2,
+		"limit_price":91,"order_userref":2,"symbol":"BTC/USD","validate":true}}`))
+	tradeintercept.Southbound([]byte(`{"method":"add_order","success":true,"result":{"order_userref":2}}`))
+	reports, _ := drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	assert.Equal(t, 2.0, reports[1]["order_userref"])
+	assert.Equal(t, PENDING_NEW, pendingOrder(tradeintercept, 1).Status)
+
+	///or cl_ord_id
+	tradeintercept.Northbound([]byte(`{"method":"add_order","params":{"order_type":"limit","side":"buy","order_qty":1,
+		"limit_price":90,"cl_ord_id":"abc","symbol":"BTC/USD","validate":true}}`))
+	tradeintercept.Southbound([]byte(`{"method":"add_order","success":true,"result":{"cl_ord_id":"abc"}}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, "abc", reports[1]["cl_ord_id"])
+	assert.Equal(t, PENDING_NEW, pendingOrder(tradeintercept, 1).Status)
+
+	///an add_order response never picks up an order from a batch with the same req_id
+	tradeintercept.Northbound([]byte(`{"method":"batch_add","req_id":5,"params":{"symbol":"BTC/USD","validate":true,
+		"orders":[{"order_type":"limit","side":"buy","limit_price":90,"order_qty":1,"order_userref":3}]}}`))
+	tradeintercept.Northbound([]byte(`{"method":"add_order","req_id":5,"params":{"order_type":"limit","side":"buy",
+		"order_qty":1,"limit_price":90,"symbol":"BTC/USD","validate":true}}`))
+	tradeintercept.Southbound([]byte(`{"method":"add_order","req_id":5,"success":true,"result":{}}`))
+	reports, _ = drain(t, tradeintercept)
+	assert.Equal(t, []string{"pending_new", "new"}, execTypes(reports))
+	assert.Equal(t, 0.0, reports[1]["order_userref"])
+	assert.Equal(t, PENDING_NEW, pendingOrder(tradeintercept, 3).Status)
+}
+
+func TestLogFilterCfg(t *testing.T) {
+	///no log-filter.json, no filters
+	setupCfg(t, map[string]string{})
+	assert.True(t, NewLogFilter().CheckFilters([]byte(`{"channel":"heartbeat"}`)))
+
+	///filters still in trade-intercept.json are used if log-filter.json has none
+	setupCfg(t, map[string]string{
+		"trade-intercept": `{"LogFilters": [{"Matchon": "heartbeat", "FilterOut": true}]}`,
+	})
+	assert.False(t, NewLogFilter().CheckFilters([]byte(`{"channel":"heartbeat"}`)))
+
+	///and ignored if it has some
+	setupCfg(t, map[string]string{
+		"trade-intercept": `{"LogFilters": [{"Matchon": "heartbeat", "FilterOut": true}]}`,
+		"log-filter":      `{"LogFilters": [{"Matchon": "pong", "FilterOut": true}]}`,
+	})
+	logfilter := NewLogFilter()
+	assert.True(t, logfilter.CheckFilters([]byte(`{"channel":"heartbeat"}`)))
+	assert.False(t, logfilter.CheckFilters([]byte(`{"method":"pong"}`)))
+}
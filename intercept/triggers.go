@@ -0,0 +1,138 @@
+package intercept
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	UNTRIGGERED = "untriggered"
+	TRIGGERED   = "triggered"
+)
+
+// / Trigger is the simulated state of a stop-loss, take-profit or trailing-stop order's trigger
+type Trigger struct {
+	Reference string
+	Price     float64
+	PriceType string
+
+	ActualPrice float64 /// the price we are waiting for, 0 until there has been a reference price to work it out from
+	PeakPrice   float64 /// trailing stops - the best reference price since the order was accepted
+	LastPrice   float64
+	Status      string
+	Timestamp   string
+}
+
+func NewTrigger(params *TriggerParams) *Trigger {
+	trigger := &Trigger{
+		Reference: "last",
+		PriceType: "static",
+		Status:    UNTRIGGERED,
+	}
+	if params != nil {
+		trigger.Price = params.Price
+		if params.Reference != "" {
+			trigger.Reference = params.Reference
+		}
+		if params.PriceType != "" {
+			trigger.PriceType = params.PriceType
+		}
+	}
+	return trigger
+}
+
+// / offset is how far the trigger price is from the price, static prices are absolute
+func (p *Trigger) offset(price float64) float64 {
+	switch p.PriceType {
+	case "pct":
+		return price * p.Price / 100
+	case "quote":
+		return p.Price
+	}
+	return p.Price - price
+}
+
+func (p *Trigger) report() *TriggerReport {
+	return &TriggerReport{
+		Reference:   p.Reference,
+		Price:       p.Price,
+		PriceType:   p.PriceType,
+		ActualPrice: p.ActualPrice,
+		PeakPrice:   p.PeakPrice,
+		LastPrice:   p.LastPrice,
+		Status:      p.Status,
+		Timestamp:   p.Timestamp,
+	}
+}
+
+// / referencePrice is the last trade price, or for the index the middle of the book (we don't get
+// /   Kraken's index), falling back to the last trade price
+func (p *TradeIntercept) referencePrice(order *Order) float64 {
+	orderbook := p.orderbooks.GetOrderbook(order.Symbol)
+	if order.Trigger.Reference == "index" {
+		if mid := orderbook.MidPrice(); mid > 0 {
+			return mid
+		}
+	}
+	return orderbook.LastPrice()
+}
+
+// / checkTrigger moves the trigger along with the reference price, and triggers the order if it has been reached.
+// /   Stop losses (and trailing stops) trigger when the price moves against us, take profits when it moves for us.
+func (p *TradeIntercept) checkTrigger(order *Order) bool {
+	trigger := order.Trigger
+	reference := p.referencePrice(order)
+	if reference <= 0 {
+		return false
+	}
+	trigger.LastPrice = reference
+	if order.IsTrailing() {
+		if trigger.PeakPrice == 0 ||
+			(order.Side == "sell" && reference > trigger.PeakPrice) ||
+			(order.Side == "buy" && reference < trigger.PeakPrice) {
+			trigger.PeakPrice = reference
+		}
+		/// the trailing offset is always away from the peak, whatever its sign, and a static price is taken as quote
+		offset := math.Abs(trigger.Price)
+		if trigger.PriceType == "pct" {
+			offset = trigger.PeakPrice * offset / 100
+		}
+		if order.Side == "sell" {
+			trigger.ActualPrice = trigger.PeakPrice - offset
+		} else {
+			trigger.ActualPrice = trigger.PeakPrice + offset
+		}
+	} else if trigger.ActualPrice == 0 {
+		/// relative prices are relative to the reference when the order is first checked
+		trigger.ActualPrice = reference + trigger.offset(reference)
+	}
+
+	priceabove := reference >= trigger.ActualPrice
+	pricebelow := reference <= trigger.ActualPrice
+	var fire bool
+	if order.IsTakeProfit() {
+		fire = (order.Side == "buy" && pricebelow) || (order.Side == "sell" && priceabove)
+	} else {
+		fire = (order.Side == "buy" && priceabove) || (order.Side == "sell" && pricebelow)
+	}
+	if !fire {
+		return false
+	}
+
+	trigger.Status = TRIGGERED
+	trigger.Timestamp = time.Now().Format(TIMEFORMAT)
+	if !order.IsMarket() {
+		switch order.LimitPriceType {
+		case "pct":
+			order.LimitPrice = trigger.ActualPrice * (1 + order.LimitPrice/100)
+		case "quote":
+			order.LimitPrice = trigger.ActualPrice + order.LimitPrice
+		}
+		order.LimitPrice = p.roundPrice(order.Symbol, order.LimitPrice)
+	}
+	p.log("triggered ", order.OrderUserref, " ", order.OrderType, " at ", reference)
+	p.traderesp <- []*Execution{p.orderReport(order, "status")}
+	p.joinQueue(order)
+	p.watchPrints(order)
+	return true
+}
@@ -0,0 +1,69 @@
+package orderbooks
+
+import (
+	"time"
+)
+
+type ConsumptionCfg struct {
+	Enabled       bool
+	ResetOnUpdate bool   /// forget what we took from a level when the book next updates it
+	DecayAfter    string /// forget what we took from a level after this long, e.g. "30s", empty for never
+}
+
+type consumed struct {
+	qty float64
+	at  time.Time
+}
+
+// / consumption is an overlay on the live book of the liquidity simulated fills have taken,
+// /   so the same level can't be filled twice. It is guarded by the orderbook's proclock.
+type consumption struct {
+	resetonupdate bool
+	decayafter    time.Duration
+
+	bids map[float64]*consumed
+	asks map[float64]*consumed
+}
+
+func newConsumption(resetonupdate bool, decayafter time.Duration) *consumption {
+	return &consumption{
+		resetonupdate: resetonupdate,
+		decayafter:    decayafter,
+		bids:          make(map[float64]*consumed),
+		asks:          make(map[float64]*consumed),
+	}
+}
+
+// / taken returns how much has been consumed at the level, dropping it if it has decayed
+func (p *consumption) taken(levels map[float64]*consumed, price float64) float64 {
+	level, ok := levels[price]
+	if !ok {
+		return 0
+	}
+	if p.decayafter > 0 && time.Since(level.at) > p.decayafter {
+		delete(levels, price)
+		return 0
+	}
+	return level.qty
+}
+
+func (p *consumption) take(levels map[float64]*consumed, price float64, qty float64) {
+	level, ok := levels[price]
+	if !ok {
+		level = &consumed{}
+		levels[price] = level
+	}
+	level.qty += qty
+	level.at = time.Now()
+}
+
+func (p *consumption) updated(levels map[float64]*consumed, price float64) {
+	if p.resetonupdate {
+		delete(levels, price)
+	}
+}
+
+func (p *consumption) clear() {
+	p.bids = make(map[float64]*consumed)
+	p.asks = make(map[float64]*consumed)
+}
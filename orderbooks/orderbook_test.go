@@ -1,59 +1,13 @@
 package orderbooks
 
-import "testing"
+import (
+	"kraken-test-proxy-v2/instruments"
+	"math"
+	"testing"
+	"time"
+)
 import "github.com/stretchr/testify/assert"
 
-func TestOrderBookMatch(t *testing.T) {
-	orderbook := NewOrderBook()
-	///Create some random bids and asks
-	bids := []*BidAsk{
-		{price: 37500, qty: 1.25},
-		{price: 37400, qty: 1.25},
-		{price: 37300, qty: 1.25},
-		{price: 37200, qty: 1.25},
-		{price: 37100, qty: 1.25},
-	}
-	asks := []*BidAsk{
-		{price: 37600, qty: 1.25},
-		{price: 37700, qty: 1.25},
-		{price: 37800, qty: 1.25},
-		{price: 37900, qty: 1.25},
-		{price: 38000, qty: 1.25},
-	}
-	///Add the bids and asks to the orderbook
-	orderbook.AddBids(bids)
-	orderbook.process()
-	orderbook.AddAsks(asks)
-	orderbook.process()
-
-	///Now create a bid and ask that should match
-	price := 37401.0
-	qty := 1.25
-	fillprice, fillqty := orderbook.MatchAsk(price, qty)
-	assert.Equal(t, 37401.0, fillprice)
-	assert.Equal(t, 1.25, fillqty)
-	//Now create a bid and ask that should not match
-	price = 37501.0
-	qty = 1.25
-	fillprice, fillqty = orderbook.MatchAsk(price, qty)
-	assert.Equal(t, 0.0, fillprice)
-	assert.Equal(t, 0.0, fillqty)
-	///Now create an ask that should match
-	/// bid for a price higher than the second highest ask - we should fill at our price
-	price = 37701.0
-	qty = 1.25
-	fillprice, fillqty = orderbook.MatchBid(price, qty)
-	assert.Equal(t, 37701.0, fillprice)
-	assert.Equal(t, 1.25, fillqty)
-	///Now create an bid higher than the highest ask - it should not fill
-	price = 37599.0
-	qty = 1.25
-	fillprice, fillqty = orderbook.MatchBid(price, qty)
-	assert.Equal(t, 0.0, fillprice)
-	assert.Equal(t, 0.0, fillqty)
-
-}
-
 func TestDirtyFlag(t *testing.T) {
 	orderbook := NewOrderBook()
 	///Create some random bids and asks
@@ -79,18 +33,10 @@ func TestDirtyFlag(t *testing.T) {
 	orderbook.process()
 
 	///Now create an ask higher than the highest bid - it should not fill
-	price := 37601.0
-	qty := 1.25
-	fillprice, fillqty := orderbook.MatchAsk(price, qty)
-	assert.Equal(t, 0.0, fillprice)
-	assert.Equal(t, 0.0, fillqty)
+	assert.Equal(t, 0, len(orderbook.WalkBids(37601, 1.25)))
 
 	///Now add a bid lower than the lowest ask - it should not fill
-	price = 37099.0
-	qty = 1.25
-	fillprice, fillqty = orderbook.MatchBid(price, qty)
-	assert.Equal(t, 0.0, fillprice)
-	assert.Equal(t, 0.0, fillqty)
+	assert.Equal(t, 0, len(orderbook.WalkAsks(37099, 1.25)))
 	///Now add some more bids higher than our ask and asks lower than our bid - they should now fill
 	bids = []*BidAsk{
 		{price: 37700, qty: 1.25}, /// this should fill the ask at 37601
@@ -117,16 +63,229 @@ func TestDirtyFlag(t *testing.T) {
 
 	///Create a bid that is lower than the lowest ask and an ask that is higher than the highest bid
 	/// to test that we annot place the order
-	price = 37099.0
-	qty = 1.25
-	fillprice, fillqty = orderbook.MatchBid(price, qty)
-	assert.Equal(t, 37099.0, fillprice)
-	assert.Equal(t, 1.25, fillqty)
-	price = 37601.0
-	qty = 1.25
-	fillprice, fillqty = orderbook.MatchAsk(price, qty)
-	assert.Equal(t, 37601.0, fillprice)
-	assert.Equal(t, 1.25, fillqty)
+	fills := orderbook.WalkAsks(37099, 1.25)
+	assert.Equal(t, []Fill{{Price: 37000, Qty: 1.25}}, fills)
+	fills = orderbook.WalkBids(37601, 1.25)
+	assert.Equal(t, []Fill{{Price: 37700, Qty: 1.25}}, fills)
 
 	///and we're done
 }
+
+func TestWalkLevels(t *testing.T) {
+	orderbook := NewOrderBook()
+	orderbook.AddBids([]*BidAsk{
+		{price: 37500, qty: 1.0},
+		{price: 37400, qty: 0.5},
+		{price: 37300, qty: 2.0},
+	})
+	orderbook.AddAsks([]*BidAsk{
+		{price: 37600, qty: 0.25},
+		{price: 37700, qty: 0.5},
+		{price: 37800, qty: 2.0},
+	})
+
+	///A buy at 37750 takes the first two ask levels, at their prices, and no more
+	fills := orderbook.WalkAsks(37750, 1.0)
+	assert.Equal(t, []Fill{{Price: 37600, Qty: 0.25}, {Price: 37700, Qty: 0.5}}, fills)
+	///A small buy only needs the first level
+	fills = orderbook.WalkAsks(38000, 0.1)
+	assert.Equal(t, []Fill{{Price: 37600, Qty: 0.1}}, fills)
+	///and a buy below the best ask gets nothing
+	assert.Equal(t, 0, len(orderbook.WalkAsks(37599, 1.0)))
+
+	///A sell at 37350 walks down the bids
+	fills = orderbook.WalkBids(37350, 2.0)
+	assert.Equal(t, []Fill{{Price: 37500, Qty: 1.0}, {Price: 37400, Qty: 0.5}}, fills)
+
+	///Qty changes at an existing price are picked up, as are removed levels
+	orderbook.AddBids([]*BidAsk{{price: 37500, qty: 0.2}, {price: 37400, qty: 0}})
+	fills = orderbook.WalkBids(37300, 1.0)
+	assert.Equal(t, []Fill{{Price: 37500, Qty: 0.2}, {Price: 37300, Qty: 0.8}}, fills)
+
+	orderbook.Clear()
+	assert.Equal(t, 0, len(orderbook.WalkBids(0, 1.0)))
+	assert.Equal(t, 0, len(orderbook.WalkAsks(1e9, 1.0)))
+}
+
+func TestConsumption(t *testing.T) {
+	sharedbook := NewSharedOrderbook(nil)
+	assert.NotNil(t, sharedbook.EnableConsumption(ConsumptionCfg{Enabled: true, DecayAfter: "not a duration"}))
+	assert.Nil(t, sharedbook.EnableConsumption(ConsumptionCfg{Enabled: true, ResetOnUpdate: true, DecayAfter: "50ms"}))
+	orderbook := sharedbook.GetOrderbook("BTC/USD")
+	orderbook.AddAsks([]*BidAsk{
+		{price: 37600, qty: 1.25},
+		{price: 37700, qty: 1.25},
+	})
+
+	fills := orderbook.WalkAsks(37700, 1.0)
+	assert.Equal(t, []Fill{{Price: 37600, Qty: 1.0}}, fills)
+	///only 0.25 left at 37600 for the next order
+	fills = orderbook.WalkAsks(37700, 1.0)
+	assert.Equal(t, []Fill{{Price: 37600, Qty: 0.25}, {Price: 37700, Qty: 0.75}}, fills)
+
+	///an update to the level resets what we took
+	orderbook.AddAsks([]*BidAsk{{price: 37600, qty: 1.0}})
+	fills = orderbook.WalkAsks(37600, 2.0)
+	assert.Equal(t, []Fill{{Price: 37600, Qty: 1.0}}, fills)
+
+	///and so does time
+	fills = orderbook.WalkAsks(37700, 1.0)
+	assert.Equal(t, []Fill{{Price: 37700, Qty: 0.5}}, fills)
+	time.Sleep(60 * time.Millisecond)
+	fills = orderbook.WalkAsks(37700, 2.0)
+	assert.Equal(t, []Fill{{Price: 37600, Qty: 1.0}, {Price: 37700, Qty: 1.0}}, fills)
+}
+
+func TestQueuePosition(t *testing.T) {
+	orderbook := NewOrderBook()
+	orderbook.AddBids([]*BidAsk{
+		{price: 37500, qty: 2},
+		{price: 37400, qty: 1},
+	})
+	///we join behind the 2 already at 37500
+	position := orderbook.JoinQueue("buy", 37500, 1)
+	assert.Equal(t, 2.0, position.Ahead())
+
+	///buys and prints below us don't touch the bid queue
+	orderbook.AddTrade("buy", 37500, 1, 0)
+	orderbook.AddTrade("sell", 37600, 1, 0)
+	assert.Equal(t, 2.0, position.Ahead())
+
+	///a sell print at our price works through the queue
+	orderbook.AddTrade("sell", 37500, 0.5, 0)
+	assert.Equal(t, 1.5, position.Ahead())
+	assert.Equal(t, 0.0, orderbook.QueueFill(position, 1))
+
+	///the level shrinking means cancels in front of us
+	orderbook.AddBids([]*BidAsk{{price: 37500, qty: 1}})
+	assert.Equal(t, 1.0, position.Ahead())
+	///but growing puts the new qty behind us
+	orderbook.AddBids([]*BidAsk{{price: 37500, qty: 3}})
+	assert.Equal(t, 1.0, position.Ahead())
+
+	///a print bigger than the queue reaches us, capped by our leaves qty
+	orderbook.AddTrade("sell", 37500, 1.25, 0)
+	assert.Equal(t, 0.0, position.Ahead())
+	assert.Equal(t, 0.25, orderbook.QueueFill(position, 1))
+	assert.Equal(t, 0.0, orderbook.QueueFill(position, 1))
+
+	///a print through our price takes the whole level
+	orderbook.AddTrade("sell", 37400, 2, 0)
+	assert.Equal(t, 0.75, orderbook.QueueFill(position, 0.75))
+
+	///once we leave, prints don't matter
+	orderbook.LeaveQueue(position)
+	orderbook.AddTrade("sell", 37500, 1, 0)
+	assert.Equal(t, 0.0, orderbook.QueueFill(position, 1))
+
+	///the sell side is the mirror image
+	orderbook.AddAsks([]*BidAsk{{price: 37600, qty: 1}})
+	position = orderbook.JoinQueue("sell", 37600, 1)
+	orderbook.AddTrade("buy", 37600, 1.5, 0)
+	assert.Equal(t, 0.5, orderbook.QueueFill(position, 1))
+}
+
+func TestSharedQueue(t *testing.T) {
+	orderbook := NewOrderBook()
+	orderbook.enableConsumption(false, 0)
+	orderbook.AddBids([]*BidAsk{{price: 37500, qty: 1}})
+	///two of our orders behind the 1 already there, the first for 1, the second for 2
+	first := orderbook.JoinQueue("buy", 37500, 1)
+	second := orderbook.JoinQueue("buy", 37500, 2)
+
+	///a print of 2 clears the 1 in front, then fills the first order - none of it is left for the second
+	orderbook.AddTrade("sell", 37500, 2, 0)
+	assert.Equal(t, 1.0, orderbook.QueueFill(first, 1))
+	assert.Equal(t, 0.0, orderbook.QueueFill(second, 2))
+	///and what we took is gone from the level
+	assert.Equal(t, 0.0, orderbook.DepthBids(37500))
+
+	///the second is at the front now
+	orderbook.AddTrade("sell", 37500, 1.5, 0)
+	assert.Equal(t, 1.5, orderbook.QueueFill(second, 2))
+
+	///a print through both our prices goes to the best priced first, never more than the print in total
+	better := orderbook.JoinQueue("buy", 37550, 1)
+	orderbook.AddTrade("sell", 37400, 1.25, 0)
+	assert.Equal(t, 1.0, orderbook.QueueFill(better, 1))
+	assert.Equal(t, 0.25, orderbook.QueueFill(second, 0.5))
+
+	///every public connection feeds the book the same print, it only counts once
+	orderbook.AddTrade("sell", 37500, 0.1, 7)
+	orderbook.AddTrade("sell", 37500, 0.1, 7)
+	assert.Equal(t, 0.1, orderbook.QueueFill(second, 0.25))
+	orderbook.AddTrade("sell", 37500, 0.1, 8)
+	assert.Equal(t, 0.1, orderbook.QueueFill(second, 0.15))
+}
+
+func TestPrints(t *testing.T) {
+	orderbook := NewOrderBook()
+	orderbook.AddTrade("buy", 37600, 1, 0)
+	cursor := orderbook.PrintCursor()
+	assert.Equal(t, int64(1), cursor)
+	prints, cursor := orderbook.PrintsSince(cursor)
+	assert.Equal(t, 0, len(prints))
+
+	orderbook.AddTrade("sell", 37500, 0.5, 0)
+	orderbook.AddTrade("buy", 37600, 0.25, 0)
+	prints, cursor = orderbook.PrintsSince(cursor)
+	assert.Equal(t, []Print{{Side: "sell", Price: 37500, Qty: 0.5}, {Side: "buy", Price: 37600, Qty: 0.25}}, prints)
+	assert.Equal(t, int64(3), cursor)
+	///what is filled from a print is used up
+	assert.Equal(t, 0.25, orderbook.TakePrint(1, 0.25))
+	assert.Equal(t, 0.25, orderbook.TakePrint(1, 1))
+	assert.Equal(t, 0.0, orderbook.TakePrint(1, 1))
+	assert.Equal(t, 0.0, orderbook.TakePrint(3, 1))
+
+	///a cursor that has fallen behind picks up from the oldest print kept
+	for i := 0; i < MAXPRINTS; i++ {
+		orderbook.AddTrade("buy", 37600, 1, 0)
+	}
+	prints, cursor = orderbook.PrintsSince(0)
+	assert.True(t, len(prints) <= MAXPRINTS)
+	assert.Equal(t, int64(MAXPRINTS+3), cursor)
+	assert.Equal(t, cursor, orderbook.PrintCursor())
+
+	///a print already added by another connection isn't added again
+	orderbook.AddTrade("sell", 37500, 1, 42)
+	cursor = orderbook.PrintCursor()
+	orderbook.AddTrade("sell", 37500, 1, 42)
+	assert.Equal(t, cursor, orderbook.PrintCursor())
+}
+
+func TestDepth(t *testing.T) {
+	orderbook := NewOrderBook()
+	orderbook.AddBids([]*BidAsk{{price: 37500, qty: 1}, {price: 37400, qty: 2}})
+	orderbook.AddAsks([]*BidAsk{{price: 37600, qty: 1}, {price: 37700, qty: 2}})
+	assert.Equal(t, 0.0, orderbook.DepthAsks(37599))
+	assert.Equal(t, 1.0, orderbook.DepthAsks(37600))
+	assert.Equal(t, 3.0, orderbook.DepthAsks(40000))
+	assert.Equal(t, 1.0, orderbook.DepthBids(37450))
+	assert.Equal(t, 3.0, orderbook.DepthBids(0))
+	assert.Equal(t, 37550.0, orderbook.MidPrice())
+}
+
+func TestRoundedFills(t *testing.T) {
+	registry, err := instruments.NewRegistry(instruments.InstrumentsCfg{Refresh: true})
+	assert.Nil(t, err)
+	assert.Nil(t, registry.Refresh([]byte(`{"channel":"instrument","type":"snapshot","data":{"pairs":[
+		{"symbol":"BTC/USD","base":"BTC","quote":"USD","qty_increment":0.01,"price_increment":0.1}]}}`)))
+	sharedorderbook := NewSharedOrderbook([]string{"BTC/USD"})
+	sharedorderbook.SetInstruments(registry)
+
+	for _, symbol := range []string{"BTC/USD", "ETH/USD"} {
+		orderbook := sharedorderbook.GetOrderbook(symbol)
+		orderbook.AddAsks([]*BidAsk{{price: 100, qty: 0.005}, {price: 101, qty: 1}})
+		fills := orderbook.WalkAsks(math.Inf(1), 0.555)
+		if symbol == "BTC/USD" {
+			///less than an increment is left at 100, and only whole increments fill at 101
+			assert.Equal(t, 1, len(fills))
+			assert.Equal(t, 101.0, fills[0].Price)
+			assert.InDelta(t, 0.55, fills[0].Qty, 1e-9)
+		} else {
+			///nothing known about it, so nothing is rounded
+			assert.Equal(t, 2, len(fills))
+			assert.InDelta(t, 0.55, fills[1].Qty, 1e-9)
+		}
+	}
+}
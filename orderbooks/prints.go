@@ -0,0 +1,94 @@
+package orderbooks
+
+const (
+	MAXPRINTS = 1000 /// how many public trade prints each book keeps for orders that haven't caught up yet
+)
+
+// / Print is a public trade, side is the taker's side
+type Print struct {
+	Side    string
+	Price   float64
+	Qty     float64
+	TradeId int64 /// Kraken's trade_id, 0 if it isn't known
+
+	used float64 /// what simulated orders have filled from it, on any connection
+}
+
+// / PrintCursor is where the next print will go, so an order placed now only sees prints from here on
+func (p *Orderbook) PrintCursor() int64 {
+	p.proclock.RLock()
+	defer p.proclock.RUnlock()
+	return p.printsbase + int64(len(p.prints))
+}
+
+// / PrintsSince returns the prints from the cursor on, and the cursor to use next time.
+// /   Prints that have been dropped to keep the list to MAXPRINTS are missed.
+func (p *Orderbook) PrintsSince(cursor int64) ([]Print, int64) {
+	p.proclock.RLock()
+	defer p.proclock.RUnlock()
+	next := p.printsbase + int64(len(p.prints))
+	if cursor < p.printsbase {
+		cursor = p.printsbase
+	}
+	if cursor >= next {
+		return nil, next
+	}
+	prints := make([]Print, next-cursor)
+	copy(prints, p.prints[cursor-p.printsbase:])
+	return prints, next
+}
+
+// / TakePrint fills up to qty from the print at the cursor, returning how much of it was left to fill. However many
+// /   orders match a print, together they never fill more than its qty.
+func (p *Orderbook) TakePrint(cursor int64, qty float64) float64 {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
+	if cursor < p.printsbase || cursor >= p.printsbase+int64(len(p.prints)) {
+		return 0
+	}
+	print := &p.prints[cursor-p.printsbase]
+	if left := print.Qty - print.used; qty > left {
+		qty = left
+	}
+	if qty <= 0 {
+		return 0
+	}
+	print.used += qty
+	return qty
+}
+
+// / LastPrice is the price of the last print (or ticker update), 0 if there hasn't been one
+func (p *Orderbook) LastPrice() float64 {
+	p.proclock.RLock()
+	defer p.proclock.RUnlock()
+	return p.lastprice
+}
+
+// / SetLastPrice is for the ticker channel's last price, prints set it themselves
+func (p *Orderbook) SetLastPrice(price float64) {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
+	p.lastprice = price
+}
+
+// / seenPrint is true if the print with the trade id has already been added, by this connection or another
+// /   subscribed to the same trades. Must hold the proclock.
+func (p *Orderbook) seenPrint(tradeid int64) bool {
+	for i := len(p.prints) - 1; i >= 0; i-- {
+		if p.prints[i].TradeId == tradeid {
+			return true
+		}
+	}
+	return false
+}
+
+// / addPrint must hold the proclock
+func (p *Orderbook) addPrint(print Print) {
+	p.lastprice = print.Price
+	if len(p.prints) >= MAXPRINTS {
+		dropped := len(p.prints) / 2
+		p.prints = append(p.prints[:0], p.prints[dropped:]...)
+		p.printsbase += int64(dropped)
+	}
+	p.prints = append(p.prints, print)
+}
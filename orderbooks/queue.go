@@ -0,0 +1,155 @@
+package orderbooks
+
+import (
+	"sort"
+)
+
+// / QueuePosition is our estimated place in the queue at a price level for a passive order.
+// /   It is guarded by the orderbook's proclock.
+type QueuePosition struct {
+	side  string /// the side of our order, buy rests on the bids, sell on the asks
+	price float64
+	seq   int64 /// when we joined, our orders at the same price queue in this order
+
+	ahead    float64 /// qty we think is in front of us
+	leaves   float64 /// our order's qty still to fill, as of the last QueueFill
+	fillable float64 /// qty that has traded past the front of the queue, ours to fill
+}
+
+// / Ahead is how much we think is still in front of us
+func (p *QueuePosition) Ahead() float64 {
+	return p.ahead
+}
+
+// / reached is whether a public trade print (side is the taker's side) gets to our price, a sell print trades
+// /   against the bids
+func (p *QueuePosition) reached(side string, price float64) bool {
+	if side == p.side {
+		return false
+	}
+	return (p.side == "buy" && price <= p.price) || (p.side == "sell" && price >= p.price)
+}
+
+// / traded applies what is left of a print, once our orders in front of us have had theirs, and returns how much
+// /   of it is ours. A print at our price eats the queue in front of us first, a print through our price means the
+// /   whole level went, including us.
+func (p *QueuePosition) traded(price float64, qty float64) float64 {
+	if price != p.price {
+		p.ahead = 0
+	}
+	if qty <= p.ahead {
+		p.ahead -= qty
+		return 0
+	}
+	qty -= p.ahead
+	p.ahead = 0
+	room := p.leaves - p.fillable
+	if qty > room {
+		///the rest goes to whoever is behind us
+		qty = room
+	}
+	if qty <= 0 {
+		return 0
+	}
+	p.fillable += qty
+	return qty
+}
+
+// / updated shrinks the queue when the level shrinks, we can't have more in front of us than is on the level.
+// /   Prints have usually been applied already, so this only catches cancels from the front.
+func (p *QueuePosition) updated(qty float64) {
+	if qty < p.ahead {
+		p.ahead = qty
+	}
+}
+
+// / JoinQueue puts a passive order for qty at the back of the queue at its price
+func (p *Orderbook) JoinQueue(side string, price float64, qty float64) *QueuePosition {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
+	p.queueseq++
+	position := &QueuePosition{
+		side:   side,
+		price:  price,
+		seq:    p.queueseq,
+		leaves: qty,
+	}
+	if side == "buy" {
+		position.ahead = p.bids[price]
+	} else {
+		position.ahead = p.asks[price]
+	}
+	p.queues[position] = struct{}{}
+	return position
+}
+
+// / LeaveQueue stops tracking the position, e.g. the order was filled or canceled, or moved price
+func (p *Orderbook) LeaveQueue(position *QueuePosition) {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
+	delete(p.queues, position)
+}
+
+// / QueueFill returns how much of our leaves qty has been filled by prints since we last asked
+func (p *Orderbook) QueueFill(position *QueuePosition, leaves float64) float64 {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
+	qty := position.fillable
+	if qty > leaves {
+		qty = leaves
+	}
+	position.fillable = 0
+	position.leaves = leaves - qty
+	return qty
+}
+
+// / AddTrade records a public trade print (side is the taker's side) and shares it out over the queue positions
+// /   it reaches - the best priced first, and at the same price in the order they joined. Together they never fill
+// /   more than the print's qty, and what our orders get is taken from their level, as for any other simulated fill.
+// /   Every public connection subscribed to the symbol's trades sees the same print, so a print with a trade id that
+// /   has already been added is ignored. A tradeid of 0 is never taken for a repeat.
+func (p *Orderbook) AddTrade(side string, price float64, qty float64, tradeid int64) {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
+	if tradeid != 0 && p.seenPrint(tradeid) {
+		return
+	}
+	p.addPrint(Print{Side: side, Price: price, Qty: qty, TradeId: tradeid})
+	positions := make([]*QueuePosition, 0)
+	for position := range p.queues {
+		if position.reached(side, price) {
+			positions = append(positions, position)
+		}
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if positions[i].price != positions[j].price {
+			///a print reaches only one side's queues, buys above it or sells below it
+			return (positions[i].side == "buy") == (positions[i].price > positions[j].price)
+		}
+		return positions[i].seq < positions[j].seq
+	})
+	given := 0.0 /// what our orders in front have had
+	for _, position := range positions {
+		ours := position.traded(price, qty-given)
+		if ours <= 0 {
+			continue
+		}
+		given += ours
+		if p.consumption != nil {
+			levels := p.consumption.bids
+			if position.side == "sell" {
+				levels = p.consumption.asks
+			}
+			p.consumption.take(levels, position.price, ours)
+		}
+	}
+}
+
+// / levelUpdated shrinks the queues at the level to fit the new qty, must hold the proclock
+func (p *Orderbook) levelUpdated(side string, price float64, qty float64) {
+	for position := range p.queues {
+		if position.side == side && position.price == price {
+			position.updated(qty)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package orderbooks
 
 import (
+	"kraken-test-proxy-v2/instruments"
+	"math"
 	"sort"
 	"sync"
+	"time"
 )
 
 type BidAsk struct {
@@ -14,7 +17,13 @@ func NewBidAsk(price float64, qty float64) *BidAsk {
 	return &BidAsk{price, qty}
 }
 
-// /for testing only - ignore qty - for now
+// / One level's worth of a fill
+type Fill struct {
+	Price float64
+	Qty   float64
+}
+
+// / Orderbook is one symbol's book, the simulated fills walk its levels (see WalkAsks and WalkBids)
 type Orderbook struct {
 	asks map[float64]float64
 	bids map[float64]float64
@@ -27,6 +36,16 @@ type Orderbook struct {
 	incomingasks chan *BidAsk
 	incomingbids chan *BidAsk
 
+	consumption *consumption /// nil if simulated fills don't take liquidity
+	queues      map[*QueuePosition]struct{}
+	queueseq    int64   /// the last queue position's seq
+	prints      []Print /// recent public trade prints, see prints.go
+	printsbase  int64   /// the cursor of the first print in the list
+	lastprice   float64 /// from the last print or ticker, 0 if we haven't seen one
+
+	symbol      string
+	instruments *instruments.Registry /// fills are rounded to the pair's qty increment, nil if they aren't
+
 	proclock sync.RWMutex
 }
 
@@ -36,11 +55,16 @@ func NewOrderBook() *Orderbook {
 		bids:         make(map[float64]float64),
 		incomingasks: make(chan *BidAsk, 500),
 		incomingbids: make(chan *BidAsk, 500),
+		queues:       make(map[*QueuePosition]struct{}),
 	}
 }
 
 type SharedOrderbook struct {
-	books map[string]*Orderbook
+	books     map[string]*Orderbook
+	bookslock sync.Mutex
+
+	consumptioncfg *ConsumptionCfg
+	instruments    *instruments.Registry
 }
 
 func NewSharedOrderbook(symbols []string) *SharedOrderbook {
@@ -49,13 +73,76 @@ func NewSharedOrderbook(symbols []string) *SharedOrderbook {
 	}
 	for _, symbol := range symbols {
 		sob.books[symbol] = NewOrderBook()
+		sob.books[symbol].symbol = symbol
 	}
 	go sob.Process()
 	return sob
 }
 
+// / EnableConsumption makes simulated fills take liquidity from the books, see ConsumptionCfg
+func (p *SharedOrderbook) EnableConsumption(consumptioncfg ConsumptionCfg) error {
+	decayafter := time.Duration(0)
+	if consumptioncfg.DecayAfter != "" {
+		var err error
+		decayafter, err = time.ParseDuration(consumptioncfg.DecayAfter)
+		if err != nil {
+			return err
+		}
+	}
+	p.bookslock.Lock()
+	defer p.bookslock.Unlock()
+	p.consumptioncfg = &consumptioncfg
+	for _, book := range p.books {
+		book.enableConsumption(consumptioncfg.ResetOnUpdate, decayafter)
+	}
+	return nil
+}
+
+func (p *Orderbook) enableConsumption(resetonupdate bool, decayafter time.Duration) {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
+	p.consumption = newConsumption(resetonupdate, decayafter)
+}
+
+// / GetOrderbook returns the book for the symbol, creating it if it isn't one of the configured symbols
 func (p *SharedOrderbook) GetOrderbook(symbol string) *Orderbook {
-	return p.books[symbol]
+	p.bookslock.Lock()
+	defer p.bookslock.Unlock()
+	book, ok := p.books[symbol]
+	if !ok {
+		book = NewOrderBook()
+		book.symbol = symbol
+		book.instruments = p.instruments
+		if p.consumptioncfg != nil {
+			decayafter, _ := time.ParseDuration(p.consumptioncfg.DecayAfter) ///already checked
+			book.enableConsumption(p.consumptioncfg.ResetOnUpdate, decayafter)
+		}
+		p.books[symbol] = book
+	}
+	return book
+}
+
+// / SetInstruments rounds simulated fills to the pairs' qty increments, so they never fill a fraction of one
+func (p *SharedOrderbook) SetInstruments(registry *instruments.Registry) {
+	p.bookslock.Lock()
+	defer p.bookslock.Unlock()
+	p.instruments = registry
+	for _, book := range p.books {
+		book.proclock.Lock()
+		book.instruments = registry
+		book.proclock.Unlock()
+	}
+}
+
+// / roundQty rounds down to the pair's qty increment, must hold the proclock
+func (p *Orderbook) roundQty(qty float64) float64 {
+	if p.instruments == nil {
+		return qty
+	}
+	if pair := p.instruments.Pair(p.symbol); pair != nil {
+		return pair.RoundQty(qty)
+	}
+	return qty
 }
 
 func (p *Orderbook) makeOrderedSlice(data map[float64]float64) []BidAsk {
@@ -71,78 +158,166 @@ func (p *Orderbook) makeOrderedSlice(data map[float64]float64) []BidAsk {
 	return ordered
 }
 
-// / Match our incoming bids and asks with the orderbook
-func (p *Orderbook) MatchBid(price float64, qty float64) (fillprice float64, fillqty float64) {
-	p.proclock.RLock()
-	defer p.proclock.RUnlock()
+// / AddBids queues the bids and processes them, so the queue never fills up
+func (p *Orderbook) AddBids(bids []*BidAsk) {
+	for _, bid := range bids {
+		select {
+		case p.incomingbids <- bid:
+		default:
+			p.process()
+			p.incomingbids <- bid
+		}
+	}
+	p.process()
+}
+
+func (p *Orderbook) AddAsks(asks []*BidAsk) {
+	for _, ask := range asks {
+		select {
+		case p.incomingasks <- ask:
+		default:
+			p.process()
+			p.incomingasks <- ask
+		}
+	}
+	p.process()
+}
+
+// / Clear empties the book, e.g. ready for a new snapshot
+func (p *Orderbook) Clear() {
+	p.process()
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
+	p.bids = make(map[float64]float64)
+	p.asks = make(map[float64]float64)
+	p.bidsdirty = true
+	p.asksdirty = true
+	if p.consumption != nil {
+		p.consumption.clear()
+	}
+}
+
+// / available is what's left at the level once simulated fills are taken off
+func (p *Orderbook) available(levels map[float64]float64, consumedlevels map[float64]*consumed, price float64) float64 {
+	qty := levels[price]
+	if p.consumption != nil {
+		qty -= p.consumption.taken(consumedlevels, price)
+	}
+	return qty
+}
+
+// / WalkAsks matches a buy at price against the asks, lowest first, taking as much of each level as is needed
+// /   to fill qty at that level's price. Returns nothing if the best ask is above our price.
+// /   With consumption enabled, what is taken is no longer available to later fills.
+func (p *Orderbook) WalkAsks(price float64, qty float64) []Fill {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
 	if p.asksdirty {
 		p.orderedasks = p.makeOrderedSlice(p.asks)
 		p.asksdirty = false
-
 	}
-	/// If our price is lower then the lowest ask, we have no match
-	///match on the highest ask price that is less than or equal to our bid price
+	fills := make([]Fill, 0)
 	for _, ask := range p.orderedasks {
-		if ask.price <= price {
-			if ask.qty <= qty {
-				fillprice = price ///we've bid at a higher price - so fill at that price -
-				// should be a worst case scenario and eak out issues with the algo
-				fillqty = ask.qty
-				return
-			} else {
-				fillprice = price
-				fillqty = qty
-				return
-			}
-		} else {
-			break //// our price is lower than the ask, so we can't match (and the list should be ordered)
+		if qty <= 0 || ask.price > price {
+			break
 		}
+		/// the ordered slice only changes when a price is added or removed, so take the qty from the map
+		levelqty := p.roundQty(math.Min(p.available(p.asks, p.consumedAsks(), ask.price), qty))
+		if levelqty <= 0 {
+			continue
+		}
+		if p.consumption != nil {
+			p.consumption.take(p.consumption.asks, ask.price, levelqty)
+		}
+		fills = append(fills, Fill{Price: ask.price, Qty: levelqty})
+		qty -= levelqty
 	}
-	return
+	return fills
 }
 
-// / NOTE: this is not a perfect matching engine - but should give something reasonable for testing
-// /   it does not adjust order book qty's after a match (for now)
-// / Match our incoming bids and asks with the orderbook - ask
-func (p *Orderbook) MatchAsk(price float64, qty float64) (fillprice float64, fillqty float64) {
-	p.proclock.RLock()
-	defer p.proclock.RUnlock()
+// / WalkBids matches a sell at price against the bids, highest first
+func (p *Orderbook) WalkBids(price float64, qty float64) []Fill {
+	p.proclock.Lock()
+	defer p.proclock.Unlock()
 	if p.bidsdirty {
 		p.orderedbids = p.makeOrderedSlice(p.bids)
 		p.bidsdirty = false
 	}
+	fills := make([]Fill, 0)
+	for i := len(p.orderedbids) - 1; i >= 0; i-- {
+		bid := p.orderedbids[i]
+		if qty <= 0 || bid.price < price {
+			break
+		}
+		levelqty := p.roundQty(math.Min(p.available(p.bids, p.consumedBids(), bid.price), qty))
+		if levelqty <= 0 {
+			continue
+		}
+		if p.consumption != nil {
+			p.consumption.take(p.consumption.bids, bid.price, levelqty)
+		}
+		fills = append(fills, Fill{Price: bid.price, Qty: levelqty})
+		qty -= levelqty
+	}
+	return fills
+}
+
+// / MidPrice is halfway between the best bid and ask, 0 if either side is empty
+func (p *Orderbook) MidPrice() float64 {
+	p.proclock.RLock()
+	defer p.proclock.RUnlock()
+	bestbid := 0.0
+	for price := range p.bids {
+		bestbid = math.Max(bestbid, price)
+	}
+	bestask := math.Inf(1)
+	for price := range p.asks {
+		bestask = math.Min(bestask, price)
+	}
+	if bestbid == 0 || math.IsInf(bestask, 1) {
+		return 0
+	}
+	return (bestbid + bestask) / 2
+}
 
-	//// go through in reverse order, match on the lowest bid price that is greater than or equal to our ask price
-	for i := 0; i < len(p.bids); i++ {
-		bid := p.orderedbids[len(p.bids)-1-i]
-		if bid.price >= price {
-			if bid.qty <= qty {
-				fillprice = price ///we've bid at a higher price - so fill at that price -
-				// should be a worst case scenario and eak out issues with the algo
-				fillqty = bid.qty
-				return
-			} else {
-				fillprice = price
-				fillqty = qty
-				return
-			}
-		} else {
-			break //// our price is higher than the bid, so we can't match (and the list should be ordered)
+// / DepthAsks is how much a buy at price could take from the asks, for fill or kill
+func (p *Orderbook) DepthAsks(price float64) float64 {
+	p.proclock.Lock() ///not a read lock, decayed consumption gets dropped
+	defer p.proclock.Unlock()
+	depth := 0.0
+	for askprice := range p.asks {
+		if askprice <= price {
+			depth += math.Max(p.available(p.asks, p.consumedAsks(), askprice), 0)
 		}
 	}
-	return
+	return depth
 }
 
-func (p *Orderbook) AddBids(bids []*BidAsk) {
-	for _, bid := range bids {
-		p.incomingbids <- bid
+// / DepthBids is how much a sell at price could take from the bids
+func (p *Orderbook) DepthBids(price float64) float64 {
+	p.proclock.Lock() ///not a read lock, decayed consumption gets dropped
+	defer p.proclock.Unlock()
+	depth := 0.0
+	for bidprice := range p.bids {
+		if bidprice >= price {
+			depth += math.Max(p.available(p.bids, p.consumedBids(), bidprice), 0)
+		}
 	}
+	return depth
 }
 
-func (p *Orderbook) AddAsks(asks []*BidAsk) {
-	for _, ask := range asks {
-		p.incomingasks <- ask
+func (p *Orderbook) consumedBids() map[float64]*consumed {
+	if p.consumption == nil {
+		return nil
 	}
+	return p.consumption.bids
+}
+
+func (p *Orderbook) consumedAsks() map[float64]*consumed {
+	if p.consumption == nil {
+		return nil
+	}
+	return p.consumption.asks
 }
 
 func (p *Orderbook) process() {
@@ -153,6 +328,10 @@ func (p *Orderbook) process() {
 		case bid := <-p.incomingbids:
 			/// go through bids, clear out any that are 0 qty, update or add others
 			_, found := p.bids[bid.price]
+			if p.consumption != nil {
+				p.consumption.updated(p.consumption.bids, bid.price)
+			}
+			p.levelUpdated("buy", bid.price, bid.qty)
 			if bid.qty == 0 {
 				p.bidsdirty = true
 				if found {
@@ -168,6 +347,10 @@ func (p *Orderbook) process() {
 		case ask := <-p.incomingasks:
 			/// go through asks, clear out any that are 0 qty, update or add others
 			_, found := p.asks[ask.price]
+			if p.consumption != nil {
+				p.consumption.updated(p.consumption.asks, ask.price)
+			}
+			p.levelUpdated("sell", ask.price, ask.qty)
 			if ask.qty == 0 {
 				p.asksdirty = true
 				if found {
@@ -188,7 +371,13 @@ func (p *Orderbook) process() {
 }
 
 func (p *SharedOrderbook) Process() {
+	p.bookslock.Lock()
+	books := make([]*Orderbook, 0, len(p.books))
 	for _, book := range p.books {
+		books = append(books, book)
+	}
+	p.bookslock.Unlock()
+	for _, book := range books {
 		book.process()
 	}
 }
@@ -1,5 +1,7 @@
 package recorder
 
+import "sync"
+
 type Message interface {
 	Type() string
 	Id() string
@@ -9,7 +11,8 @@ type Message interface {
 type MessageReplay struct {
 	incoming chan Message
 
-	msgs map[string][]Message
+	msgs     map[string][]Message
+	msgslock sync.RWMutex
 }
 
 func NewMessageReplay() *MessageReplay {
@@ -25,11 +28,13 @@ func (p *MessageReplay) Process() {
 	//// dequeu the messages and put into the map
 	for {
 		msg := <-p.incoming
+		p.msgslock.Lock()
 		if _, ok := p.msgs[msg.Id()]; !ok {
 			//// create a new list
 			p.msgs[msg.Id()] = make([]Message, 0)
 		}
 		p.msgs[msg.Id()] = append(p.msgs[msg.Id()], msg)
+		p.msgslock.Unlock()
 	}
 }
 
@@ -38,5 +43,9 @@ func (p *MessageReplay) AddMessage(msg Message) {
 }
 
 func (p *MessageReplay) Replay(id string) []Message {
-	return p.msgs[id]
+	p.msgslock.RLock()
+	defer p.msgslock.RUnlock()
+	msgs := make([]Message, len(p.msgs[id]))
+	copy(msgs, p.msgs[id])
+	return msgs
 }
@@ -0,0 +1,364 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	HEARTBEAT_INTERVAL = time.Second
+)
+
+var ErrPlaybackClosed = errors.New("playback closed")
+
+type PlaybackCfg struct {
+	Enabled  bool
+	File     string   /// a recording, or a directory of recordings which are played back oldest first
+	Speed    float64  /// 1 for the original timing, 2 for twice as fast etc, 0 for no delay at all
+	Step     bool     /// only send a message when stepped, see Playback.Step
+	Channels []string /// the channels to play back, defaults to book, trade and ticker
+}
+
+func (p *PlaybackCfg) Expand() {
+	p.File = os.ExpandEnv(p.File)
+}
+
+// / Playback stands in for the public Kraken feed, sending the southbound market data from a recording
+// /   to whoever is subscribed to it
+type Playback struct {
+	files    []string
+	speed    float64
+	step     bool
+	channels map[string]bool
+
+	reader    *bufio.Reader
+	current   *os.File
+	next      *Record
+	nextts    time.Time
+	nextroute [2]string /// channel and symbol of next
+	finished  bool
+
+	startrec  time.Time
+	startwall time.Time
+
+	sublock       sync.Mutex
+	subscriptions map[string]map[string]bool /// channel -> symbols
+	subscribed    chan struct{}
+
+	responses chan []byte
+	steps     chan struct{}
+	heartbeat *time.Ticker
+	closed    chan struct{}
+	closeonce sync.Once
+}
+
+func NewPlayback(playbackcfg PlaybackCfg) (*Playback, error) {
+	files := []string{playbackcfg.File}
+	info, err := os.Stat(playbackcfg.File)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		files, err = ListRecordings(playbackcfg.File)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no recordings in %s", playbackcfg.File)
+		}
+	}
+	channels := playbackcfg.Channels
+	if len(channels) == 0 {
+		channels = []string{"book", "trade", "ticker"}
+	}
+	playback := &Playback{
+		files:         files,
+		speed:         playbackcfg.Speed,
+		step:          playbackcfg.Step,
+		channels:      make(map[string]bool),
+		subscriptions: make(map[string]map[string]bool),
+		subscribed:    make(chan struct{}, 1),
+		responses:     make(chan []byte, 100),
+		steps:         make(chan struct{}, 10000),
+		heartbeat:     time.NewTicker(HEARTBEAT_INTERVAL),
+		closed:        make(chan struct{}),
+	}
+	for _, channel := range channels {
+		playback.channels[channel] = true
+	}
+	return playback, nil
+}
+
+func (p *Playback) Close() {
+	p.closeonce.Do(func() {
+		p.heartbeat.Stop()
+		close(p.closed)
+		if p.current != nil {
+			p.current.Close()
+		}
+	})
+}
+
+func (p *Playback) IsClosed() bool {
+	select {
+	case <-p.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// / Step releases count messages when the playback is in step mode
+func (p *Playback) Step(count int) {
+	for i := 0; i < count; i++ {
+		select {
+		case p.steps <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+func (p *Playback) respond(resp map[string]interface{}, reqid interface{}, timein time.Time) {
+	if reqid != nil {
+		resp["req_id"] = reqid
+	}
+	resp["time_in"] = timein.Format(TIMEFORMAT)
+	resp["time_out"] = time.Now().UTC().Format(TIMEFORMAT)
+	msg, err := json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	select {
+	case p.responses <- msg:
+	case <-p.closed:
+	}
+}
+
+// / SendMsg answers pings and (un)subscribes, anything else gets an error as there is no exchange to send it to
+func (p *Playback) SendMsg(data []byte) error {
+	if p.IsClosed() {
+		return ErrPlaybackClosed
+	}
+	timein := time.Now().UTC()
+	datamap := make(map[string]interface{})
+	err := json.Unmarshal(data, &datamap)
+	if err != nil {
+		p.respond(map[string]interface{}{"success": false, "error": "EGeneral:Invalid arguments"}, nil, timein)
+		return nil
+	}
+	method, _ := datamap["method"].(string)
+	reqid := datamap["req_id"]
+	params, _ := datamap["params"].(map[string]interface{})
+
+	switch method {
+	case "ping":
+		p.respond(map[string]interface{}{"method": "pong"}, reqid, timein)
+	case "subscribe", "unsubscribe":
+		channel, _ := params["channel"].(string)
+		symbols, _ := params["symbol"].([]interface{})
+		p.updateSubscription(method == "subscribe", channel, symbols)
+		result := map[string]interface{}{}
+		for key, val := range params {
+			if key != "token" {
+				result[key] = val
+			}
+		}
+		p.respond(map[string]interface{}{"method": method, "success": true, "result": result}, reqid, timein)
+	default:
+		p.respond(map[string]interface{}{"method": method, "success": false,
+			"error": "EGeneral:Invalid arguments:playback only supports market data"}, reqid, timein)
+	}
+	return nil
+}
+
+func (p *Playback) updateSubscription(subscribe bool, channel string, symbols []interface{}) {
+	p.sublock.Lock()
+	defer p.sublock.Unlock()
+	if subscribe {
+		if _, ok := p.subscriptions[channel]; !ok {
+			p.subscriptions[channel] = make(map[string]bool)
+		}
+		for _, symbol := range symbols {
+			p.subscriptions[channel][fmt.Sprint(symbol)] = true
+		}
+		select {
+		case p.subscribed <- struct{}{}:
+		default:
+		}
+		return
+	}
+	for _, symbol := range symbols {
+		delete(p.subscriptions[channel], fmt.Sprint(symbol))
+	}
+	if len(p.subscriptions[channel]) == 0 {
+		delete(p.subscriptions, channel)
+	}
+}
+
+func (p *Playback) isSubscribed(channel string, symbol string) bool {
+	p.sublock.Lock()
+	defer p.sublock.Unlock()
+	symbols, ok := p.subscriptions[channel]
+	if !ok {
+		return false
+	}
+	///channels without symbols (e.g. instrument) match any subscription to the channel
+	return symbol == "" || len(symbols) == 0 || symbols[symbol]
+}
+
+func (p *Playback) hasSubscriptions() bool {
+	p.sublock.Lock()
+	defer p.sublock.Unlock()
+	return len(p.subscriptions) > 0
+}
+
+// / messageRoute pulls out the channel and symbol of a market data message
+func messageRoute(msg []byte) (channel string, symbol string) {
+	peek := struct {
+		Channel string            `json:"channel"`
+		Data    []json.RawMessage `json:"data"`
+	}{}
+	if json.Unmarshal(msg, &peek) != nil {
+		return "", ""
+	}
+	if len(peek.Data) > 0 {
+		entry := struct {
+			Symbol string `json:"symbol"`
+		}{}
+		if json.Unmarshal(peek.Data[0], &entry) == nil {
+			symbol = entry.Symbol
+		}
+	}
+	return peek.Channel, symbol
+}
+
+func (p *Playback) readLine() ([]byte, error) {
+	for {
+		if p.reader == nil {
+			if len(p.files) == 0 {
+				return nil, io.EOF
+			}
+			file, err := os.Open(p.files[0])
+			if err != nil {
+				return nil, err
+			}
+			p.files = p.files[1:]
+			p.current = file
+			p.reader = bufio.NewReader(file)
+		}
+		line, err := p.reader.ReadBytes('\n')
+		if len(line) > 0 && (err == nil || err == io.EOF) {
+			return line, nil
+		}
+		p.current.Close()
+		p.current = nil
+		p.reader = nil
+		if err != io.EOF {
+			return nil, err
+		}
+	}
+}
+
+// / loadNext reads forward to the next southbound market data message in the recording
+func (p *Playback) loadNext() error {
+	for p.next == nil && !p.finished {
+		line, err := p.readLine()
+		if err == io.EOF {
+			p.finished = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record := &Record{}
+		if json.Unmarshal(line, record) != nil {
+			continue
+		}
+		/// injected messages came from the intercept, not the exchange
+		if record.Direction != SOUTH || record.Channel != "public" || record.Disposition == INJECTED {
+			continue
+		}
+		channel, symbol := messageRoute(record.Msg)
+		if !p.channels[channel] {
+			continue
+		}
+		ts, err := time.Parse(TIMEFORMAT, record.Timestamp)
+		if err != nil {
+			continue
+		}
+		p.next = record
+		p.nextts = ts
+		p.nextroute = [2]string{channel, symbol}
+	}
+	return nil
+}
+
+func (p *Playback) due() <-chan time.Time {
+	if p.speed <= 0 || p.startwall.IsZero() {
+		return time.After(0)
+	}
+	elapsed := time.Duration(float64(p.nextts.Sub(p.startrec)) / p.speed)
+	return time.After(time.Until(p.startwall.Add(elapsed)))
+}
+
+// / RecvMsg returns the next response or market data message, sending heartbeats while there is nothing to send
+func (p *Playback) RecvMsg() (data []byte, err error) {
+	for {
+		select {
+		case resp := <-p.responses:
+			return resp, nil
+		case <-p.closed:
+			return nil, ErrPlaybackClosed
+		default:
+		}
+
+		var ready <-chan time.Time
+		var step <-chan struct{}
+		if p.hasSubscriptions() {
+			err = p.loadNext()
+			if err != nil {
+				return nil, err
+			}
+			if p.next != nil && !p.isSubscribed(p.nextroute[0], p.nextroute[1]) {
+				///not wanted by this client - the timing is absolute, so it can just be skipped
+				p.next = nil
+				continue
+			}
+			if p.next != nil {
+				if p.step {
+					step = p.steps
+				} else {
+					ready = p.due()
+				}
+			}
+		}
+
+		select {
+		case resp := <-p.responses:
+			return resp, nil
+		case <-p.subscribed:
+			continue
+		case <-p.heartbeat.C:
+			return []byte(`{"channel":"heartbeat"}`), nil
+		case <-p.closed:
+			return nil, ErrPlaybackClosed
+		case <-ready:
+		case <-step:
+		}
+
+		record := p.next
+		p.next = nil
+		if p.startwall.IsZero() {
+			p.startrec = p.nextts
+			p.startwall = time.Now()
+		}
+		return record.Msg, nil
+	}
+}
@@ -0,0 +1,98 @@
+package recorder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSession(t *testing.T, dir string) {
+	recorder, err := NewRecorder(RecorderCfg{Enabled: true, Dir: dir})
+	assert.Nil(t, err)
+	msgs := []struct {
+		direction   string
+		channel     string
+		disposition string
+		msg         string
+	}{
+		{NORTH, "public", FORWARDED, `{"method":"subscribe","params":{"channel":"book","symbol":["BTC/USD"]}}`},
+		{SOUTH, "public", FORWARDED, `{"method":"subscribe","success":true}`},
+		{SOUTH, "public", FORWARDED, `{"channel":"book","type":"snapshot","data":[{"symbol":"BTC/USD","bids":[],"asks":[]}]}`},
+		{SOUTH, "public", FORWARDED, `{"channel":"heartbeat"}`},
+		{SOUTH, "public", FORWARDED, `{"channel":"book","type":"update","data":[{"symbol":"ETH/USD","bids":[],"asks":[]}]}`},
+		{SOUTH, "private", FORWARDED, `{"channel":"executions","type":"update","data":[]}`},
+		{SOUTH, "public", INJECTED, `{"channel":"trade","type":"update","data":[{"symbol":"BTC/USD"}]}`},
+		{SOUTH, "public", DROPPED, `{"channel":"trade","type":"update","data":[{"symbol":"BTC/USD","price":100}]}`},
+		{SOUTH, "public", FORWARDED, `{"channel":"book","type":"update","data":[{"symbol":"BTC/USD","bids":[],"asks":[]}]}`},
+	}
+	for _, msg := range msgs {
+		assert.Nil(t, recorder.Record(msg.direction, 1, msg.channel, msg.disposition, []byte(msg.msg)))
+	}
+	assert.Nil(t, recorder.Close())
+}
+
+func TestPlayback(t *testing.T) {
+	dir := t.TempDir()
+	writeSession(t, dir)
+
+	playback, err := NewPlayback(PlaybackCfg{Enabled: true, File: dir, Speed: 0})
+	assert.Nil(t, err)
+	defer playback.Close()
+
+	assert.Nil(t, playback.SendMsg([]byte(`{"method":"subscribe","req_id":5,"params":{"channel":"book","symbol":["BTC/USD"]}}`)))
+	msg, err := playback.RecvMsg()
+	assert.Nil(t, err)
+	assert.Contains(t, string(msg), `"req_id":5`)
+
+	msg, err = playback.RecvMsg()
+	assert.Nil(t, err)
+	assert.Contains(t, string(msg), `"type":"snapshot"`)
+
+	/// ETH is not subscribed and there is no trade subscription, so the next is the last book update
+	msg, err = playback.RecvMsg()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"channel":"book","type":"update","data":[{"symbol":"BTC/USD","bids":[],"asks":[]}]}`, string(msg))
+
+	///and after that there is only the heartbeat
+	msg, err = playback.RecvMsg()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"channel":"heartbeat"}`, string(msg))
+}
+
+func TestPlaybackStep(t *testing.T) {
+	dir := t.TempDir()
+	writeSession(t, dir)
+
+	playback, err := NewPlayback(PlaybackCfg{Enabled: true, File: dir, Step: true, Channels: []string{"book", "trade"}})
+	assert.Nil(t, err)
+	defer playback.Close()
+	assert.Nil(t, playback.SendMsg([]byte(`{"method":"subscribe","params":{"channel":"book","symbol":["BTC/USD"]}}`)))
+	assert.Nil(t, playback.SendMsg([]byte(`{"method":"subscribe","params":{"channel":"trade","symbol":["BTC/USD"]}}`)))
+	playback.RecvMsg()
+	playback.RecvMsg()
+
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			msg, err := playback.RecvMsg()
+			if err != nil {
+				return
+			}
+			if string(msg) != `{"channel":"heartbeat"}` {
+				received <- msg
+			}
+		}
+	}()
+	select {
+	case msg := <-received:
+		t.Fatal("received message without stepping ", string(msg))
+	case <-time.After(100 * time.Millisecond):
+	}
+	playback.Step(2)
+	msg := <-received
+	assert.Contains(t, string(msg), `"type":"snapshot"`)
+	msg = <-received
+	///dropped messages came from Kraken, so are played back
+	assert.Contains(t, string(msg), `"price":100`)
+}
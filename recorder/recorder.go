@@ -0,0 +1,172 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TIMEFORMAT = "2006-01-02T15:04:05.000000Z"
+
+	NORTH = "north"
+	SOUTH = "south"
+
+	FORWARDED = "forwarded"
+	DROPPED   = "dropped"
+	INJECTED  = "injected"
+
+	FILEPREFIX = "session-"
+	FILESUFFIX = ".jsonl"
+)
+
+type RecorderCfg struct {
+	Enabled  bool
+	Dir      string
+	MaxBytes int64 /// rotate to a new file once the current one reaches this size, 0 for no rotation
+	MaxFiles int   /// remove the oldest recordings when there are more than this, 0 to keep everything
+}
+
+func (p *RecorderCfg) Expand() {
+	p.Dir = os.ExpandEnv(p.Dir)
+}
+
+// / One line of a recording
+type Record struct {
+	Timestamp   string          `json:"timestamp"`
+	Direction   string          `json:"direction"`
+	Connection  int64           `json:"connection"`
+	Channel     string          `json:"channel"` /// public or private
+	Disposition string          `json:"disposition"`
+	Msg         json.RawMessage `json:"msg"`
+}
+
+// / Recorder writes every frame it is given to a JSONL file, rotating the file by size
+type Recorder struct {
+	dir      string
+	maxbytes int64
+	maxfiles int
+
+	lock    sync.Mutex
+	file    *os.File
+	written int64
+	fileseq int
+}
+
+func NewRecorder(recordercfg RecorderCfg) (*Recorder, error) {
+	err := os.MkdirAll(recordercfg.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	recorder := &Recorder{
+		dir:      recordercfg.Dir,
+		maxbytes: recordercfg.MaxBytes,
+		maxfiles: recordercfg.MaxFiles,
+	}
+	err = recorder.rotate()
+	if err != nil {
+		return nil, err
+	}
+	return recorder, nil
+}
+
+func (p *Recorder) rotate() error {
+	if p.file != nil {
+		err := p.file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	p.fileseq++
+	///names sort in the order they were written
+	filename := fmt.Sprintf("%s%s-%06d%s", FILEPREFIX, time.Now().UTC().Format("20060102T150405"), p.fileseq, FILESUFFIX)
+	file, err := os.OpenFile(filepath.Join(p.dir, filename), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.file = file
+	p.written = 0
+	return p.prune()
+}
+
+func (p *Recorder) prune() error {
+	if p.maxfiles <= 0 {
+		return nil
+	}
+	recordings, err := ListRecordings(p.dir)
+	if err != nil {
+		return err
+	}
+	for len(recordings) > p.maxfiles {
+		err = os.Remove(recordings[0])
+		if err != nil {
+			return err
+		}
+		recordings = recordings[1:]
+	}
+	return nil
+}
+
+// / ListRecordings returns the recordings in dir, oldest first
+func ListRecordings(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), FILEPREFIX) || !strings.HasSuffix(entry.Name(), FILESUFFIX) {
+			continue
+		}
+		recordings = append(recordings, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(recordings)
+	return recordings, nil
+}
+
+func (p *Recorder) Record(direction string, connection int64, channel string, disposition string, msg []byte) error {
+	record := Record{
+		Timestamp:   time.Now().UTC().Format(TIMEFORMAT),
+		Direction:   direction,
+		Connection:  connection,
+		Channel:     channel,
+		Disposition: disposition,
+		Msg:         msg,
+	}
+	if !json.Valid(msg) {
+		///keep the line valid JSON even if the frame is not
+		quoted, err := json.Marshal(string(msg))
+		if err != nil {
+			return err
+		}
+		record.Msg = quoted
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.maxbytes > 0 && p.written > 0 && p.written+int64(len(line)) > p.maxbytes {
+		err = p.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := p.file.Write(line)
+	p.written += int64(n)
+	return err
+}
+
+func (p *Recorder) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.file.Close()
+}
@@ -0,0 +1,60 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readRecords(t *testing.T, filename string) []Record {
+	file, err := os.Open(filename)
+	assert.Nil(t, err)
+	defer file.Close()
+	records := make([]Record, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := Record{}
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRecordAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := NewRecorder(RecorderCfg{Enabled: true, Dir: dir, MaxBytes: 400, MaxFiles: 2})
+	assert.Nil(t, err)
+
+	assert.Nil(t, recorder.Record(NORTH, 1, "private", FORWARDED, []byte(`{"method":"ping","req_id":1}`)))
+	assert.Nil(t, recorder.Record(SOUTH, 1, "private", INJECTED, []byte(`not json`)))
+
+	recordings, err := ListRecordings(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(recordings))
+	records := readRecords(t, recordings[0])
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, NORTH, records[0].Direction)
+	assert.Equal(t, int64(1), records[0].Connection)
+	assert.Equal(t, "private", records[0].Channel)
+	assert.Equal(t, FORWARDED, records[0].Disposition)
+	assert.JSONEq(t, `{"method":"ping","req_id":1}`, string(records[0].Msg))
+	assert.Equal(t, `"not json"`, string(records[1].Msg))
+
+	///Each record is well over 100 bytes, so this should roll over a few times
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, recorder.Record(SOUTH, 2, "public", DROPPED, []byte(`{"channel":"heartbeat"}`)))
+	}
+	assert.Nil(t, recorder.Close())
+
+	recordings, err = ListRecordings(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(recordings))
+	for _, recording := range recordings {
+		for _, record := range readRecords(t, recording) {
+			assert.Equal(t, DROPPED, record.Disposition)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	accounts2 "kraken-test-proxy-v2/accounts"
+	instruments2 "kraken-test-proxy-v2/instruments"
+	"kraken-test-proxy-v2/intercept"
+	orderbooks2 "kraken-test-proxy-v2/orderbooks"
+	"kraken-test-proxy-v2/recorder"
+	"kraken-test-proxy-v2/upstream"
+	"log"
+	"sort"
+	"sync"
+)
+
+// / Everything an interceptor might need to know about the connection it is created for
+type InterceptContext struct {
+	Private       bool
+	ConnId        int64
+	EnableLogging bool
+	Upstream      string /// the kind of upstream, see the upstream package
+
+	MsgReplay   *recorder.MessageReplay
+	Orderbooks  *orderbooks2.SharedOrderbook
+	Account     *accounts2.Account     /// the simulated account, from the account query parameter
+	Instruments *instruments2.Registry /// the pairs, shared by every connection
+	Ids         intercept.IdGenerator  /// shared by every connection, nil for each trade intercept to make its own
+}
+
+type InterceptFactory func(ctx *InterceptContext) (Intercept, error)
+
+var registrylock sync.Mutex
+var registry = make(map[string]InterceptFactory)
+
+// / RegisterIntercept makes an interceptor available by name to the Intercepts config in server.json.
+// /   Call it before Listen to add your own.
+func RegisterIntercept(name string, factory InterceptFactory) {
+	registrylock.Lock()
+	defer registrylock.Unlock()
+	registry[name] = factory
+}
+
+func RegisteredIntercepts() []string {
+	registrylock.Lock()
+	defer registrylock.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterIntercept("logfilter", func(ctx *InterceptContext) (Intercept, error) {
+		return intercept.NewLogFilter(), nil
+	})
+	RegisterIntercept(ORDERGUARD, func(ctx *InterceptContext) (Intercept, error) {
+		return intercept.NewOrderGuard(ctx.Upstream == upstream.KRAKEN), nil
+	})
+	RegisterIntercept("trade", func(ctx *InterceptContext) (Intercept, error) {
+		tradeintercept := intercept.NewTradeIntercept(ctx.EnableLogging, ctx.MsgReplay, ctx.Orderbooks, ctx.Account,
+			ctx.Instruments)
+		if ctx.Ids != nil {
+			tradeintercept.SetIdGenerator(ctx.Ids)
+		}
+		return tradeintercept, nil
+	})
+}
+
+// / Chain runs messages through a list of interceptors. Northbound messages go through the stages in order,
+// /   southbound in reverse, so the first stage is the one nearest the trading engine. A stage dropping a message
+// /   stops it reaching the rest. Injected messages go straight to the trading engine.
+type Chain struct {
+	stages []Intercept
+}
+
+const ORDERGUARD = "orderguard"
+
+// / withOrderGuard makes the order guard the stage nearest the trading engine whenever orders could reach the real
+// /   exchange, whatever the config says - left out, or behind the trade intercept, it would let live orders through
+func withOrderGuard(names []string, ctx *InterceptContext) []string {
+	if ctx.Upstream != upstream.KRAKEN {
+		return names
+	}
+	if len(names) == 0 || names[0] != ORDERGUARD {
+		log.Println("WARNING: the upstream is Kraken, so", ORDERGUARD, "is put first in the interceptors", names)
+	}
+	guarded := []string{ORDERGUARD}
+	for _, name := range names {
+		if name != ORDERGUARD {
+			guarded = append(guarded, name)
+		}
+	}
+	return guarded
+}
+
+func NewChain(names []string, ctx *InterceptContext) (*Chain, error) {
+	names = withOrderGuard(names, ctx)
+	chain := &Chain{
+		stages: make([]Intercept, 0, len(names)),
+	}
+	for _, name := range names {
+		registrylock.Lock()
+		factory, ok := registry[name]
+		registrylock.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("no interceptor registered as %s", name)
+		}
+		stage, err := factory(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating interceptor %s: %w", name, err)
+		}
+		chain.stages = append(chain.stages, stage)
+	}
+	return chain, nil
+}
+
+func (p *Chain) Northbound(msg []byte) (out []byte, forward bool) {
+	for _, stage := range p.stages {
+		msg, forward = stage.Northbound(msg)
+		if !forward {
+			return msg, false
+		}
+	}
+	return msg, true
+}
+
+func (p *Chain) Southbound(msg []byte) (out []byte, forward bool) {
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		msg, forward = p.stages[i].Southbound(msg)
+		if !forward {
+			return msg, false
+		}
+	}
+	return msg, true
+}
+
+func (p *Chain) InjectSouth() (msg []byte) {
+	for _, stage := range p.stages {
+		msg = stage.InjectSouth()
+		if msg != nil {
+			return msg
+		}
+	}
+	return nil
+}
+
+func (p *Chain) Close() {
+	for _, stage := range p.stages {
+		if closer, ok := stage.(Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// / A message is logged only if every stage with a log filter agrees
+func (p *Chain) CheckFilters(msg []byte) (logmsg bool) {
+	for _, stage := range p.stages {
+		filter, ok := stage.(LogFilter)
+		if ok && !filter.CheckFilters(msg) {
+			return false
+		}
+	}
+	return true
+}
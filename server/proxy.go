@@ -5,13 +5,18 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/paul-at-nangalan/errorhandler/handlers"
 	"github.com/paul-at-nangalan/json-config/cfg"
-	"kraken-test-proxy-v2/client"
+	accounts2 "kraken-test-proxy-v2/accounts"
+	instruments2 "kraken-test-proxy-v2/instruments"
 	"kraken-test-proxy-v2/intercept"
 	orderbooks2 "kraken-test-proxy-v2/orderbooks"
 	"kraken-test-proxy-v2/recorder"
+	"kraken-test-proxy-v2/upstream"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,43 +33,105 @@ type Config struct {
 	LogPrivate bool
 	LogPublic  bool
 
+	Offline bool ///serve both endpoints from the simulated exchange - no connection is made to Kraken
+
+	/// kraken, exchange or replay - overrides Offline and Replay.Enabled for the endpoint
+	PublicUpstream  string
+	PrivateUpstream string
+
 	OrderbookSymbols []string
+	Consumption      orderbooks2.ConsumptionCfg  ///simulated fills take liquidity from the shared books
+	Balances         accounts2.BalancesCfg       ///simulated balances for the accounts
+	Margin           accounts2.MarginCfg         ///simulated margin positions for the accounts
+	Instruments      instruments2.InstrumentsCfg ///the pairs to check and round simulated orders to
+
+	/// The interceptors to chain together for each endpoint, by registered name, nearest the trading engine first
+	PublicIntercepts  []string
+	PrivateIntercepts []string
+
+	Recording recorder.RecorderCfg ///record every frame to JSONL files
+	Replay    recorder.PlaybackCfg ///serve the public endpoint from a recording
 }
 
 func (p *Config) Expand() {
 	p.Certfile = os.ExpandEnv(p.Certfile)
 	p.Keyfile = os.ExpandEnv(p.Keyfile)
+	p.Recording.Expand()
+	p.Replay.Expand()
+	p.Margin.Expand()
+	p.Instruments.Expand()
 }
 
 var cfgsvr *Config
 var orderbooks *orderbooks2.SharedOrderbook
+var accounts *accounts2.Accounts
+var instruments *instruments2.Registry
+var ids intercept.IdGenerator
 
+var defaultIntercepts = []string{"orderguard", "logfilter", "trade"}
+
+// / Each stage can pass a message on as is, rewrite it by returning a different out, drop it by returning
+// /   forward false, or inject its own messages
 type Intercept interface {
-	Northbound(msg []byte) (forward bool)
-	Southbound(msg []byte) (forward bool)
+	Northbound(msg []byte) (out []byte, forward bool)
+	Southbound(msg []byte) (out []byte, forward bool)
+
+	InjectSouth() (msg []byte) /// nil for no message
+}
+
+// / Interceptors with timers (or anything else) to stop once the connection has gone
+type Closer interface {
+	Close()
+}
 
-	InjectSouth() (msg []byte)             /// nil for no message
+// / Interceptors that also decide which messages get logged
+type LogFilter interface {
 	CheckFilters(msg []byte) (logmsg bool) /// For whether to log the message or not
 }
 
+// / The south side of the proxy, normally the websocket to the trading engine
+type ClientConn interface {
+	ReadMessage() (messageType int, p []byte, err error)
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
 type WebSockProxy struct {
 	intercept     Intercept
-	conn          *websocket.Conn
-	relay         *client.Relay
+	conn          ClientConn
+	relay         upstream.Upstream
 	enablelogging bool
+
+	msgrecorder *recorder.Recorder /// nil if recording is disabled
+	connid      int64
+	channel     string
 }
 
-func NewWebSockProxy(intercept Intercept, conn *websocket.Conn, relay *client.Relay, enablelogging bool) *WebSockProxy {
+func NewWebSockProxy(intercept Intercept, conn ClientConn, relay upstream.Upstream, enablelogging bool,
+	msgrecorder *recorder.Recorder, connid int64, private bool) *WebSockProxy {
+
+	channel := "public"
+	if private {
+		channel = "private"
+	}
 	wsp := &WebSockProxy{
 		intercept:     intercept,
 		conn:          conn,
 		relay:         relay,
 		enablelogging: enablelogging,
+		msgrecorder:   msgrecorder,
+		connid:        connid,
+		channel:       channel,
 	}
 	return wsp
 }
 
 var msgreplay *recorder.MessageReplay
+var msgrecorder *recorder.Recorder
+var lastconnid int64
+
+var playbacklock sync.Mutex
+var playbacks = make(map[int64]*recorder.Playback)
 
 func Listen() {
 	cfgsvr = &Config{}
@@ -72,31 +139,75 @@ func Listen() {
 	handlers.PanicOnError(err)
 
 	orderbooks = orderbooks2.NewSharedOrderbook(cfgsvr.OrderbookSymbols)
+	if cfgsvr.Consumption.Enabled {
+		err = orderbooks.EnableConsumption(cfgsvr.Consumption)
+		handlers.PanicOnError(err)
+	}
+
+	accounts = accounts2.NewAccounts(cfgsvr.Balances, cfgsvr.Margin)
+
+	///the trade intercepts read their own config, this is for what they share
+	tradeinterceptcfg := intercept.TradeInterceptCfg{}
+	if err := cfg.Read("trade-intercept", &tradeinterceptcfg); err != nil {
+		log.Println("No trade-intercept config", err)
+	}
+	legacyAssetPairs(&cfgsvr.Instruments, &tradeinterceptcfg)
+	instruments, err = instruments2.NewRegistry(cfgsvr.Instruments)
+	handlers.PanicOnError(err)
+	orderbooks.SetInstruments(instruments)
+
+	///one id generator for every connection, so they never hand out the same ids, even from the same IdSeed
+	ids = intercept.NewKrakenIds(tradeinterceptcfg.IdSeed)
 
 	http.HandleFunc("/private", wsHandlerPrivate)
 	http.HandleFunc("/public", wsHandlerPublic)
+	http.HandleFunc("/replay/step", stepHandler)
 
 	////Create a message replayer
 	msgreplay = recorder.NewMessageReplay()
 
+	if cfgsvr.Recording.Enabled {
+		msgrecorder, err = recorder.NewRecorder(cfgsvr.Recording)
+		handlers.PanicOnError(err)
+	}
+
 	err = http.ListenAndServeTLS(cfgsvr.Port, cfgsvr.Certfile, cfgsvr.Keyfile, nil)
 	handlers.PanicOnError(err)
 }
 
 func (p *WebSockProxy) logmsg(msg []byte, preffix string) {
-	if p.enablelogging && p.intercept.CheckFilters(msg) {
+	if !p.enablelogging {
+		return
+	}
+	filter, ok := p.intercept.(LogFilter)
+	if !ok || filter.CheckFilters(msg) {
 		fmt.Println(preffix, " - ", time.Now().Format("2006-01-02 15:04:05"), ":", string(msg))
 	}
 }
 
+func (p *WebSockProxy) record(direction string, disposition string, msg []byte) {
+	if p.msgrecorder == nil {
+		return
+	}
+	err := p.msgrecorder.Record(direction, p.connid, p.channel, disposition, msg)
+	if err != nil {
+		log.Println("Failed to record message", err)
+	}
+}
+
 func (p *WebSockProxy) southbound() {
 	defer handlers.HandlePanic()
 	defer p.conn.Close()
 	defer p.relay.Close()
+	///the southbound thread owns the intercepts' state, so it is the one to close them
+	if closer, ok := p.intercept.(Closer); ok {
+		defer closer.Close()
+	}
 	for {
-		injectmsg := p.intercept.InjectSouth()
-		if injectmsg != nil {
+		///send everything the intercepts have queued up, one upstream message can queue several
+		for injectmsg := p.intercept.InjectSouth(); injectmsg != nil; injectmsg = p.intercept.InjectSouth() {
 			p.logmsg(injectmsg, "s-inj")
+			p.record(recorder.SOUTH, recorder.INJECTED, injectmsg)
 			err := p.conn.WriteMessage(websocket.BinaryMessage, injectmsg)
 			if err != nil {
 				log.Println("Send error south", err)
@@ -110,10 +221,13 @@ func (p *WebSockProxy) southbound() {
 			return
 		}
 		p.logmsg(msg, "s")
-		if !p.intercept.Southbound(msg) {
+		msg, forward := p.intercept.Southbound(msg)
+		if !forward {
 			p.logmsg(msg, "s-dropped")
+			p.record(recorder.SOUTH, recorder.DROPPED, msg)
 			continue
 		}
+		p.record(recorder.SOUTH, recorder.FORWARDED, msg)
 
 		err = p.conn.WriteMessage(websocket.BinaryMessage, msg)
 		if err != nil {
@@ -134,10 +248,13 @@ func (p *WebSockProxy) northbound() {
 			return
 		}
 		p.logmsg(message, "n")
-		if !p.intercept.Northbound(message) {
+		message, forward := p.intercept.Northbound(message)
+		if !forward {
 			p.logmsg(message, "n-dropped")
+			p.record(recorder.NORTH, recorder.DROPPED, message)
 			continue
 		}
+		p.record(recorder.NORTH, recorder.FORWARDED, message)
 		err = p.relay.SendMsg(message)
 		if err != nil {
 			log.Println("Send error north", err)
@@ -146,6 +263,22 @@ func (p *WebSockProxy) northbound() {
 	}
 }
 
+// / legacyAssetPairs picks up AssetPairs from trade-intercept.json, where it was before the pairs moved to
+// /   Instruments in server.json, so configs that still have it keep their checks
+func legacyAssetPairs(instrumentscfg *instruments2.InstrumentsCfg, tradeinterceptcfg *intercept.TradeInterceptCfg) {
+	if tradeinterceptcfg.AssetPairs == "" {
+		return
+	}
+	if instrumentscfg.AssetPairs == "" {
+		log.Println("WARNING: AssetPairs in trade-intercept.json has moved to Instruments.AssetPairs in server.json,",
+			"using", tradeinterceptcfg.AssetPairs)
+		instrumentscfg.AssetPairs = tradeinterceptcfg.AssetPairs
+		return
+	}
+	log.Println("WARNING: ignoring AssetPairs", tradeinterceptcfg.AssetPairs, "in trade-intercept.json, using",
+		"Instruments.AssetPairs", instrumentscfg.AssetPairs, "in server.json")
+}
+
 func wsHandler(w http.ResponseWriter, r *http.Request, private bool) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -153,7 +286,17 @@ func wsHandler(w http.ResponseWriter, r *http.Request, private bool) {
 		return
 	}
 	fmt.Println("Connecting private channel", private)
-	relay := client.Connect(private)
+	connid := atomic.AddInt64(&lastconnid, 1)
+	kind := upstreamKind(private)
+	relay, err := upstream.Connect(kind, private, cfgsvr.Replay)
+	if err != nil {
+		log.Println("Failed to connect upstream", err)
+		conn.Close()
+		return
+	}
+	if playback, ok := relay.(*recorder.Playback); ok {
+		addPlayback(connid, playback)
+	}
 
 	enablelogging := false
 	if private && cfgsvr.LogPrivate {
@@ -162,8 +305,31 @@ func wsHandler(w http.ResponseWriter, r *http.Request, private bool) {
 		enablelogging = true
 	}
 
-	msgintercept := intercept.NewTradeIntercept(enablelogging, msgreplay, orderbooks)
-	wshandler := NewWebSockProxy(msgintercept, conn, relay, enablelogging)
+	stages := cfgsvr.PublicIntercepts
+	if private {
+		stages = cfgsvr.PrivateIntercepts
+	}
+	if len(stages) == 0 {
+		stages = defaultIntercepts
+	}
+	msgintercept, err := NewChain(stages, &InterceptContext{
+		Private:       private,
+		ConnId:        connid,
+		EnableLogging: enablelogging,
+		Upstream:      kind,
+		MsgReplay:     msgreplay,
+		Orderbooks:    orderbooks,
+		Account:       accounts.GetAccount(r.URL.Query().Get("account")),
+		Instruments:   instruments,
+		Ids:           ids,
+	})
+	if err != nil {
+		log.Println("Failed to create interceptors", err)
+		relay.Close()
+		conn.Close()
+		return
+	}
+	wshandler := NewWebSockProxy(msgintercept, conn, relay, enablelogging, msgrecorder, connid, private)
 
 	go wshandler.southbound()
 	go wshandler.northbound()
@@ -174,3 +340,50 @@ func wsHandlerPrivate(w http.ResponseWriter, r *http.Request) {
 func wsHandlerPublic(w http.ResponseWriter, r *http.Request) {
 	wsHandler(w, r, false)
 }
+
+func upstreamKind(private bool) string {
+	if private && cfgsvr.PrivateUpstream != "" {
+		return cfgsvr.PrivateUpstream
+	}
+	if !private && cfgsvr.PublicUpstream != "" {
+		return cfgsvr.PublicUpstream
+	}
+	if !private && cfgsvr.Replay.Enabled {
+		return upstream.REPLAY
+	}
+	if cfgsvr.Offline {
+		return upstream.EXCHANGE
+	}
+	return upstream.KRAKEN
+}
+
+func addPlayback(connid int64, playback *recorder.Playback) {
+	playbacklock.Lock()
+	defer playbacklock.Unlock()
+	playbacks[connid] = playback
+}
+
+// / Step every open playback on by count messages (default 1) - only has an effect when Replay.Step is set
+func stepHandler(w http.ResponseWriter, r *http.Request) {
+	count := 1
+	if countparam := r.URL.Query().Get("count"); countparam != "" {
+		var err error
+		count, err = strconv.Atoi(countparam)
+		if err != nil || count < 1 {
+			http.Error(w, "count must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	playbacklock.Lock()
+	defer playbacklock.Unlock()
+	stepped := 0
+	for connid, playback := range playbacks {
+		if playback.IsClosed() {
+			delete(playbacks, connid)
+			continue
+		}
+		playback.Step(count)
+		stepped++
+	}
+	fmt.Fprintln(w, "stepped", stepped, "playbacks by", count)
+}
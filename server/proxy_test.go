@@ -0,0 +1,281 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/paul-at-nangalan/json-config/cfg"
+	"github.com/stretchr/testify/assert"
+	accounts2 "kraken-test-proxy-v2/accounts"
+	"kraken-test-proxy-v2/exchange"
+	instruments2 "kraken-test-proxy-v2/instruments"
+	"kraken-test-proxy-v2/intercept"
+	orderbooks2 "kraken-test-proxy-v2/orderbooks"
+	"kraken-test-proxy-v2/recorder"
+	"kraken-test-proxy-v2/upstream"
+)
+
+// / In memory stand in for the trading engine's websocket
+type testClientConn struct {
+	incoming chan []byte
+	written  chan []byte
+
+	closed    chan struct{}
+	closeonce sync.Once
+}
+
+func newTestClientConn() *testClientConn {
+	return &testClientConn{
+		incoming: make(chan []byte, 10),
+		written:  make(chan []byte, 10),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (p *testClientConn) ReadMessage() (int, []byte, error) {
+	select {
+	case msg := <-p.incoming:
+		return websocket.TextMessage, msg, nil
+	case <-p.closed:
+		return 0, nil, errors.New("closed")
+	}
+}
+
+func (p *testClientConn) WriteMessage(messageType int, data []byte) error {
+	select {
+	case p.written <- data:
+		return nil
+	case <-p.closed:
+		return errors.New("closed")
+	}
+}
+
+func (p *testClientConn) Close() error {
+	p.closeonce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+// / drops anything containing "drop" and injects a message whenever it sees "inject"
+type testIntercept struct {
+	inject chan []byte
+	closed chan struct{} /// closed by Close, if set
+}
+
+func (p *testIntercept) Close() {
+	if p.closed != nil {
+		close(p.closed)
+	}
+}
+
+func (p *testIntercept) Northbound(msg []byte) (out []byte, forward bool) {
+	if strings.Contains(string(msg), "inject") {
+		p.inject <- []byte(`{"injected":true}`)
+	}
+	return msg, !strings.Contains(string(msg), "drop")
+}
+
+func (p *testIntercept) Southbound(msg []byte) (out []byte, forward bool) {
+	return msg, !strings.Contains(string(msg), "drop")
+}
+
+func (p *testIntercept) InjectSouth() (msg []byte) {
+	if len(p.inject) > 0 {
+		return <-p.inject
+	}
+	return nil
+}
+
+// / rewrites "from" to "to" in both directions
+type rewriteIntercept struct {
+	from string
+	to   string
+}
+
+func (p *rewriteIntercept) Northbound(msg []byte) (out []byte, forward bool) {
+	return []byte(strings.ReplaceAll(string(msg), p.from, p.to)), true
+}
+
+func (p *rewriteIntercept) Southbound(msg []byte) (out []byte, forward bool) {
+	return []byte(strings.ReplaceAll(string(msg), p.from, p.to)), true
+}
+
+func (p *rewriteIntercept) InjectSouth() (msg []byte) {
+	return nil
+}
+
+func waitFor(t *testing.T, msgs <-chan []byte) string {
+	select {
+	case msg := <-msgs:
+		return string(msg)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return ""
+}
+
+func TestProxyLoop(t *testing.T) {
+	conn := newTestClientConn()
+	relay := upstream.NewMemory()
+	testintercept := &testIntercept{inject: make(chan []byte, 10), closed: make(chan struct{})}
+	proxy := NewWebSockProxy(testintercept, conn, relay, false, nil, 1, true)
+	go proxy.southbound()
+	go proxy.northbound()
+
+	conn.incoming <- []byte(`{"method":"drop"}`)
+	conn.incoming <- []byte(`{"method":"ping"}`)
+	assert.Equal(t, `{"method":"ping"}`, waitFor(t, relay.Sent()))
+
+	relay.Push([]byte(`{"method":"drop"}`))
+	relay.Push([]byte(`{"method":"pong"}`))
+	assert.Equal(t, `{"method":"pong"}`, waitFor(t, conn.written))
+
+	///the southbound loop is waiting on the upstream, so injections go out once the next upstream message wakes it
+	conn.incoming <- []byte(`{"method":"inject"}`)
+	assert.Equal(t, `{"method":"inject"}`, waitFor(t, relay.Sent()))
+	relay.Push([]byte(`{"channel":"heartbeat"}`))
+	assert.Equal(t, `{"channel":"heartbeat"}`, waitFor(t, conn.written))
+	assert.Equal(t, `{"injected":true}`, waitFor(t, conn.written))
+
+	///losing the upstream closes the client
+	relay.Close()
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Fatal("client connection was not closed")
+	}
+	///and the intercepts are told
+	select {
+	case <-testintercept.closed:
+	case <-time.After(time.Second):
+		t.Fatal("intercept was not closed")
+	}
+}
+
+func TestProxyLoopManyOrders(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "trade-intercept.json"), []byte(`{"Enabled": true, "FeeRatio": 0.0026}`), 0644))
+	cfg.Setup(dir)
+	registry, err := instruments2.NewRegistry(instruments2.InstrumentsCfg{})
+	assert.Nil(t, err)
+	tradeintercept := intercept.NewTradeIntercept(false, recorder.NewMessageReplay(),
+		orderbooks2.NewSharedOrderbook([]string{"BTC/USD"}),
+		accounts2.NewAccount(accounts2.DEFAULT, accounts2.BalancesCfg{}, accounts2.MarginCfg{}), registry)
+	conn := newTestClientConn()
+	relay := exchange.NewExchange(true)
+	proxy := NewWebSockProxy(tradeintercept, conn, relay, false, nil, 1, true)
+	go proxy.southbound()
+	go proxy.northbound()
+	defer conn.Close()
+
+	///every order puts more reports in the trade intercept's queues than one upstream message takes out
+	const orders = 300
+	go func() {
+		for i := 1; i <= orders; i++ {
+			select {
+			case conn.incoming <- []byte(fmt.Sprintf(`{"method":"add_order","req_id":%d,"params":{"order_type":"limit",
+				"side":"buy","order_qty":1,"limit_price":100,"order_userref":%d,"symbol":"BTC/USD"}}`, i, i)):
+			case <-conn.closed:
+				return
+			}
+		}
+	}()
+	filled := 0
+	timeout := time.After(10 * time.Second)
+	for filled < orders {
+		select {
+		case msg := <-conn.written:
+			filled += strings.Count(string(msg), `"exec_type":"filled"`)
+		case <-timeout:
+			t.Fatalf("only %d of %d orders filled", filled, orders)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	RegisterIntercept("test-rewrite-a", func(ctx *InterceptContext) (Intercept, error) {
+		return &rewriteIntercept{from: "a", to: "b"}, nil
+	})
+	RegisterIntercept("test-rewrite-b", func(ctx *InterceptContext) (Intercept, error) {
+		return &rewriteIntercept{from: "b", to: "c"}, nil
+	})
+	RegisterIntercept("test-drop", func(ctx *InterceptContext) (Intercept, error) {
+		return &testIntercept{inject: make(chan []byte, 10)}, nil
+	})
+	assert.Contains(t, RegisteredIntercepts(), "trade")
+	assert.Contains(t, RegisteredIntercepts(), "logfilter")
+
+	_, err := NewChain([]string{"test-rewrite-a", "no-such-intercept"}, &InterceptContext{})
+	assert.NotNil(t, err)
+
+	chain, err := NewChain([]string{"test-rewrite-a", "test-rewrite-b", "test-drop"}, &InterceptContext{})
+	assert.Nil(t, err)
+
+	///north goes through the stages in order, south in reverse
+	out, forward := chain.Northbound([]byte("a"))
+	assert.True(t, forward)
+	assert.Equal(t, "c", string(out))
+	out, forward = chain.Southbound([]byte("a"))
+	assert.True(t, forward)
+	assert.Equal(t, "b", string(out))
+
+	_, forward = chain.Northbound([]byte("drop"))
+	assert.False(t, forward)
+
+	assert.Nil(t, chain.InjectSouth())
+	chain.Northbound([]byte("inject"))
+	assert.Equal(t, `{"injected":true}`, string(chain.InjectSouth()))
+	assert.True(t, chain.CheckFilters([]byte("anything")))
+}
+
+func TestChainOrderGuard(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "order-guard.json"), []byte(`{"DANGER_ALLOW_LIVE_ORDERS": false}`), 0644))
+	cfg.Setup(dir)
+	RegisterIntercept("test-drop", func(ctx *InterceptContext) (Intercept, error) {
+		return &testIntercept{inject: make(chan []byte, 10)}, nil
+	})
+	order := []byte(`{"method":"add_order","req_id":1,"params":{"order_qty":1}}`)
+
+	///left out of the config, the guard is still there in front of everything when the upstream is Kraken
+	chain, err := NewChain([]string{"test-drop"}, &InterceptContext{Upstream: upstream.KRAKEN})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(chain.stages))
+	_, forward := chain.Northbound(order)
+	assert.False(t, forward)
+	assert.Contains(t, string(chain.InjectSouth()), "live orders are blocked")
+
+	///listed after another stage, it is moved to the front
+	chain, err = NewChain([]string{"test-drop", ORDERGUARD}, &InterceptContext{Upstream: upstream.KRAKEN})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(chain.stages))
+	_, forward = chain.Northbound(order)
+	assert.False(t, forward)
+
+	///nothing to guard against otherwise
+	chain, err = NewChain([]string{"test-drop"}, &InterceptContext{Upstream: upstream.EXCHANGE})
+	assert.Nil(t, err)
+	_, forward = chain.Northbound(order)
+	assert.True(t, forward)
+}
+
+func TestLegacyAssetPairs(t *testing.T) {
+	tradeinterceptcfg := &intercept.TradeInterceptCfg{AssetPairs: "./old-pairs.json"}
+
+	///the old key is used if the new one isn't set
+	instrumentscfg := instruments2.InstrumentsCfg{}
+	legacyAssetPairs(&instrumentscfg, tradeinterceptcfg)
+	assert.Equal(t, "./old-pairs.json", instrumentscfg.AssetPairs)
+
+	instrumentscfg = instruments2.InstrumentsCfg{AssetPairs: "./new-pairs.json"}
+	legacyAssetPairs(&instrumentscfg, tradeinterceptcfg)
+	assert.Equal(t, "./new-pairs.json", instrumentscfg.AssetPairs)
+}
@@ -0,0 +1,72 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrMemoryClosed = errors.New("memory upstream closed")
+
+// / Memory is an upstream that lives entirely in memory - whatever is pushed into it is received by the proxy,
+// /   and whatever the proxy sends can be read back with Sent. Mostly for tests.
+type Memory struct {
+	north chan []byte
+	south chan []byte
+
+	closed    chan struct{}
+	closeonce sync.Once
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		north:  make(chan []byte, 100),
+		south:  make(chan []byte, 100),
+		closed: make(chan struct{}),
+	}
+}
+
+func (p *Memory) SendMsg(data []byte) error {
+	select {
+	case <-p.closed:
+		return ErrMemoryClosed
+	default:
+	}
+	select {
+	case p.north <- data:
+		return nil
+	case <-p.closed:
+		return ErrMemoryClosed
+	}
+}
+
+func (p *Memory) RecvMsg() (data []byte, err error) {
+	select {
+	case msg := <-p.south:
+		return msg, nil
+	case <-p.closed:
+		return nil, ErrMemoryClosed
+	}
+}
+
+func (p *Memory) Close() {
+	p.closeonce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// / Push queues a message for the proxy to receive
+func (p *Memory) Push(msg []byte) {
+	select {
+	case p.south <- msg:
+	case <-p.closed:
+	}
+}
+
+// / Sent is where the messages the proxy sends upstream end up
+func (p *Memory) Sent() <-chan []byte {
+	return p.north
+}
+
+func (p *Memory) Closed() <-chan struct{} {
+	return p.closed
+}
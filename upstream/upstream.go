@@ -0,0 +1,37 @@
+package upstream
+
+import (
+	"fmt"
+	"kraken-test-proxy-v2/client"
+	"kraken-test-proxy-v2/exchange"
+	"kraken-test-proxy-v2/recorder"
+)
+
+const (
+	KRAKEN   = "kraken"   /// relay to the real exchange
+	EXCHANGE = "exchange" /// the simulated exchange
+	REPLAY   = "replay"   /// play back a recording, public endpoint only
+)
+
+// / Upstream is the exchange side of a proxied connection
+type Upstream interface {
+	SendMsg(data []byte) error
+	RecvMsg() (data []byte, err error)
+	Close()
+}
+
+// / Connect creates an upstream of the given kind, an empty kind connects to Kraken
+func Connect(kind string, private bool, playbackcfg recorder.PlaybackCfg) (Upstream, error) {
+	switch kind {
+	case KRAKEN, "":
+		return client.Connect(private), nil
+	case EXCHANGE:
+		return exchange.NewExchange(private), nil
+	case REPLAY:
+		if private {
+			return nil, fmt.Errorf("the %s upstream can only be used for the public endpoint", REPLAY)
+		}
+		return recorder.NewPlayback(playbackcfg)
+	}
+	return nil, fmt.Errorf("unknown upstream %s", kind)
+}